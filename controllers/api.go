@@ -0,0 +1,129 @@
+package controllers
+
+import (
+	"chat_server/models"
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/astaxie/beego"
+	"github.com/astaxie/beego/logs"
+)
+
+const (
+	API_LIST_DEFAULT_LENGTH = 100
+)
+
+var (
+	// service -> secret, from "api_credentials = <service>:<secret>;...".
+	// The REST API refuses everybody when it's empty.
+	g_api_credentials = _LoadApiCredentials()
+)
+
+func _LoadApiCredentials() map[string]string {
+	r := make(map[string]string)
+	for _, v := range models.ConfStrings("api_credentials") {
+		kv := strings.SplitN(strings.TrimSpace(v), ":", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			if v != "" {
+				logs.Warning("Malformed api credential ignored, it should be \"<service>:<secret>\".")
+			}
+			continue
+		}
+		r[kv[0]] = kv[1]
+	}
+
+	return r
+}
+
+// ApiController serves the backend services over HTTP. A service
+// authenticates with HTTP basic auth, its name and secret must be one of
+// "api_credentials".
+type ApiController struct {
+	beego.Controller
+
+	cur_service string
+}
+
+func (this *ApiController) Prepare() {
+	service, secret, ok := this.Ctx.Request.BasicAuth()
+	expected, is_known := g_api_credentials[service]
+	if !ok || !is_known || subtle.ConstantTimeCompare([]byte(secret), []byte(expected)) != 1 {
+		logs.Error("Api request with bad credentials, service: \"%s\", from: %s", service, _RemoteIP(this.Ctx.Request))
+		this._ErrReply(http.StatusUnauthorized, API_AUTH_ERR, nil)
+		this.StopRun()
+	}
+
+	this.cur_service = service
+}
+
+// @router /messages [post]
+func (this *ApiController) PostMessage() {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(this.Ctx.Input.RequestBody, &fields); err != nil {
+		logs.Error("Request Body is NOT in JSON format. Error:", err.Error())
+		this._ErrReply(http.StatusBadRequest, PARSE_JSON_ERR, nil)
+		return
+	}
+
+	var req SendMsgReq
+	if errs := _DecodeFields(fields, &req); len(errs) != 0 {
+		this._ErrReply(http.StatusBadRequest, PARAM_ERR, errs)
+		return
+	}
+
+	// a service isn't a member of the room, everybody in it gets the message.
+	receivers := req.Receivers
+	if req.Room != "" {
+		receivers = models.ListRoomMembers(req.Room)
+		if len(receivers) == 0 {
+			this._ErrReply(http.StatusBadRequest, PARAM_ERR, []FieldError{{"room", FIELD_INVALID}})
+			return
+		}
+	}
+
+	e, unix_ns := _NewServiceMsgEvent(this.cur_service, req.Room, req.Msg)
+	_SaveMsgEvent(e, unix_ns, receivers)
+	_Publish(e, unix_ns, receivers)
+
+	logs.Info("Service \"%s\" sent msg \"%s\" to %d receivers.", this.cur_service, e.MsgId, len(receivers))
+	this._Reply(SendMsgReply{ReplyHeader: this._ReplyHeader("messages"), MsgId: e.MsgId, Timestamp: e.Timestamp})
+}
+
+// @router /users [get]
+func (this *ApiController) ListUsers() {
+	start, err := this.GetInt("start", 0)
+	if err != nil || start < 0 {
+		this._ErrReply(http.StatusBadRequest, PARAM_ERR, []FieldError{{"start", FIELD_INVALID}})
+		return
+	}
+	length, err := this.GetInt("length", API_LIST_DEFAULT_LENGTH)
+	if err != nil || length < 0 {
+		this._ErrReply(http.StatusBadRequest, PARAM_ERR, []FieldError{{"length", FIELD_INVALID}})
+		return
+	}
+
+	users := models.ListAllUser(start, length)
+	this._Reply(UsersReply{ReplyHeader: this._ReplyHeader("users"), Users: users})
+}
+
+// @router /online [get]
+func (this *ApiController) ListOnline() {
+	users := K_Broker.OnlineUsers()
+	this._Reply(UsersReply{ReplyHeader: this._ReplyHeader("online"), Users: users})
+}
+
+func (this *ApiController) _ReplyHeader(t string) ReplyHeader {
+	return ReplyHeader{Version: 1, Code: 0, Type: t}
+}
+
+func (this *ApiController) _Reply(v interface{}) {
+	this.Data["json"] = v
+	this.ServeJSON()
+}
+
+func (this *ApiController) _ErrReply(status, err_code int, errs []FieldError) {
+	this.Ctx.Output.SetStatus(status)
+	this._Reply(ErrorReply{Code: err_code, Reason: ERR_REPLYS[err_code], Errors: errs})
+}
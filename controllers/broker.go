@@ -0,0 +1,216 @@
+package controllers
+
+import (
+	"chat_server/models"
+
+	"sync"
+
+	"github.com/astaxie/beego/logs"
+)
+
+// Envelope is a message on its way to the devices of a user, wherever in
+// the cluster they are connected.
+type Envelope struct {
+	User string `json:"user"`
+	Data []byte `json:"data"`
+	// ephemeral messages, e.g. typing events, are dropped instead of
+	// going to the offline store if the user can't get them.
+	IsEphemeral bool  `json:"ephemeral,omitempty"`
+	UnixNs      int64 `json:"unix_ns,omitempty"`
+	// a device of the user which must not get it, e.g. the sender of a
+	// mirrored message.
+	SkipConn string `json:"skip_conn,omitempty"`
+	// instead of getting Data, the devices of the user are disconnected,
+	// e.g. when the user is deleted.
+	IsKick bool `json:"kick,omitempty"`
+}
+
+// Broker routes messages between the nodes of a cluster. Online and
+// Offline maintain the cluster-wide view of which node holds which user,
+// they're called when the first device of a user connects to this node and
+// when the last one leaves.
+type Broker interface {
+	Publish(env Envelope)
+	Broadcast(data []byte)
+	Online(user string)
+	Offline(user string)
+	// Locate returns the nodes the user is connected to.
+	Locate(user string) []string
+	// OnlineUsers returns the users connected to any node.
+	OnlineUsers() []string
+
+	// SetPresence records the presence status of "user" for the cluster,
+	// it returns the status it replaces.
+	SetPresence(user, status string) string
+	// Presence returns the statuses of "users", PRESENCE_OFFLINE for the
+	// ones which have none.
+	Presence(users []string) map[string]string
+	// PublishPresence hands the presence event "data" of "user" to every
+	// node, each one pushes it to the subscribers it holds.
+	PublishPresence(user string, data []byte)
+}
+
+var (
+	K_Broker = _NewBroker()
+)
+
+func _NewBroker() Broker {
+	switch name := models.ConfString("broker", "local"); name {
+	case "redis":
+		r, err := NewRedisBroker(models.ConfString("broker_redis_addr", "localhost:6379"), models.ConfString("node_id", ""), K_Hub)
+		if err != nil {
+			logs.Critical("Create redis broker failed, fall back to the local one. Error: ", err.Error())
+			return NewLocalBroker(K_Hub)
+		}
+		return r
+
+	case "local":
+		return NewLocalBroker(K_Hub)
+
+	default:
+		logs.Critical("Unknown broker \"%s\", fall back to the local one.", name)
+		return NewLocalBroker(K_Hub)
+	}
+}
+
+// _DeliverLocal hands "env" to the devices of its user in "hub", if none
+// of them takes it the message goes to the offline store.
+func _DeliverLocal(hub *Hub, env Envelope) {
+	// a receiver whose devices are all gone or evicted gets it later.
+	if !_SendLocal(hub, env) {
+		_StoreOffline(env)
+	}
+}
+
+// _SendLocal hands "env" to the devices of its user in "hub", it returns
+// false if none of them takes it. A durable message some device
+// took is stored later only if none of them gets it.
+func _SendLocal(hub *Hub, env Envelope) bool {
+	var delivery *_Delivery
+	if !env.IsEphemeral && !env.IsKick {
+		delivery = _NewDelivery(env)
+	}
+
+	is_sent := false
+	for _, conn := range hub.Lookup(env.User) {
+		if conn.id == env.SkipConn {
+			continue
+		}
+		if env.IsKick {
+			logs.Info("Kick user \"%s\", conn: %p", env.User, conn)
+			conn.Close()
+			is_sent = true
+			continue
+		}
+		if delivery != nil {
+			delivery._Add()
+		}
+		if conn.Send(Message{receiver: env.User, msg: env.Data, is_durable: !env.IsEphemeral, unix_ns: env.UnixNs, delivery: delivery}) {
+			is_sent = true
+		} else if delivery != nil {
+			delivery._Done(false)
+		}
+	}
+	// the caller stores a message no device took.
+	if delivery != nil && is_sent {
+		delivery._Done(false)
+	}
+
+	return is_sent
+}
+
+func _StoreOffline(env Envelope) {
+	if !env.IsEphemeral {
+		models.SaveOfflineMsg(env.User, env.Data, env.UnixNs)
+	}
+}
+
+func _BroadcastLocal(hub *Hub, data []byte) {
+	for k, v := range hub.Snapshot() {
+		for _, conn := range v {
+			conn.Send(Message{receiver: k, msg: data})
+		}
+	}
+}
+
+// LocalBroker serves a single node, every user is either connected to this
+// process or offline.
+type LocalBroker struct {
+	hub  *Hub
+	lock sync.Mutex
+	// user -> status, users which are not in it are offline.
+	presence map[string]string
+}
+
+func NewLocalBroker(hub *Hub) *LocalBroker {
+	r := new(LocalBroker)
+	r.hub = hub
+	r.presence = make(map[string]string)
+
+	return r
+}
+
+func (this *LocalBroker) Publish(env Envelope) {
+	_DeliverLocal(this.hub, env)
+}
+
+func (this *LocalBroker) Broadcast(data []byte) {
+	_BroadcastLocal(this.hub, data)
+}
+
+func (this *LocalBroker) Online(user string) {}
+
+func (this *LocalBroker) Offline(user string) {}
+
+func (this *LocalBroker) Locate(user string) []string {
+	if len(this.hub.Lookup(user)) == 0 {
+		return []string{}
+	}
+
+	return []string{"local"}
+}
+
+func (this *LocalBroker) OnlineUsers() []string {
+	users := make([]string, 0)
+	for k := range this.hub.Snapshot() {
+		users = append(users, k)
+	}
+
+	return users
+}
+
+func (this *LocalBroker) SetPresence(user, status string) string {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	old, ok := this.presence[user]
+	if !ok {
+		old = PRESENCE_OFFLINE
+	}
+	if status == PRESENCE_OFFLINE {
+		delete(this.presence, user)
+	} else {
+		this.presence[user] = status
+	}
+
+	return old
+}
+
+func (this *LocalBroker) Presence(users []string) map[string]string {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	r := make(map[string]string)
+	for _, v := range users {
+		r[v] = PRESENCE_OFFLINE
+		if status, ok := this.presence[v]; ok {
+			r[v] = status
+		}
+	}
+
+	return r
+}
+
+func (this *LocalBroker) PublishPresence(user string, data []byte) {
+	_NotifyPresence(this.hub, user, data)
+}
@@ -0,0 +1,305 @@
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/astaxie/beego/logs"
+	"github.com/gomodule/redigo/redis"
+)
+
+const (
+	REDIS_USER_KEY          = "chat:user:%s"
+	REDIS_PRESENCE_KEY      = "chat:presence"
+	REDIS_NODE_CHANNEL      = "chat:node:%s"
+	REDIS_BROADCAST_CHANNEL = "chat:broadcast"
+	REDIS_PRESENCE_CHANNEL  = "chat:presence"
+
+	REDIS_RETRY_INTERVAL = 3 * time.Second
+)
+
+var (
+	// swaps the status of a user in REDIS_PRESENCE_KEY, offline users have
+	// none, and returns the old one.
+	g_redis_set_presence = redis.NewScript(1, `
+local old = redis.call("HGET", KEYS[1], ARGV[1])
+if ARGV[2] == "`+PRESENCE_OFFLINE+`" then
+	redis.call("HDEL", KEYS[1], ARGV[1])
+else
+	redis.call("HSET", KEYS[1], ARGV[1], ARGV[2])
+end
+return old`)
+)
+
+// RedisBroker connects the nodes of a cluster through redis. Every user
+// maps to the set of the nodes it is connected to, and every node listens
+// on a pub/sub channel of its own for the envelopes of its users.
+type RedisBroker struct {
+	node string
+	pool *redis.Pool
+	// the users connected to this node.
+	hub *Hub
+}
+
+func NewRedisBroker(addr, node string, hub *Hub) (*RedisBroker, error) {
+	if node == "" {
+		host, err := os.Hostname()
+		if err != nil {
+			return nil, err
+		}
+		node = fmt.Sprintf("%s-%d", host, os.Getpid())
+	}
+
+	r := new(RedisBroker)
+	r.node = node
+	r.hub = hub
+	r.pool = &redis.Pool{
+		MaxIdle:     16,
+		IdleTimeout: 240 * time.Second,
+		Dial: func() (redis.Conn, error) {
+			return redis.Dial("tcp", addr)
+		},
+	}
+
+	c := r.pool.Get()
+	defer c.Close()
+	if _, err := c.Do("PING"); err != nil {
+		return nil, err
+	}
+
+	go r._Subscribe()
+
+	logs.Info("Redis broker of node \"%s\" connected to %s", r.node, addr)
+	return r, nil
+}
+
+func (this *RedisBroker) Publish(env Envelope) {
+	nodes := this.Locate(env.User)
+	if len(nodes) == 0 {
+		// nobody holds the user, here is as good as any node to store it.
+		_DeliverLocal(this.hub, env)
+		return
+	}
+
+	data, err := json.Marshal(env)
+	if err != nil {
+		logs.Error("Envelope Marshal failed. Error: ", err.Error())
+		return
+	}
+
+	c := this.pool.Get()
+	defer c.Close()
+
+	is_sent := false
+	for _, node := range nodes {
+		if node == this.node {
+			if _SendLocal(this.hub, env) {
+				is_sent = true
+			}
+			continue
+		}
+
+		n, err := redis.Int(c.Do("PUBLISH", fmt.Sprintf(REDIS_NODE_CHANNEL, node), data))
+		if err != nil {
+			logs.Error("Redis PUBLISH to node \"%s\" failed. Error: %s", node, err.Error())
+			continue
+		}
+		if n == 0 {
+			// the node is gone without saying goodbye.
+			logs.Warning("Node \"%s\" is NOT listening, drop it from user \"%s\".", node, env.User)
+			c.Do("SREM", fmt.Sprintf(REDIS_USER_KEY, env.User), node)
+			continue
+		}
+		is_sent = true
+	}
+
+	if !is_sent {
+		_StoreOffline(env)
+	}
+}
+
+func (this *RedisBroker) Broadcast(data []byte) {
+	c := this.pool.Get()
+	defer c.Close()
+
+	if _, err := c.Do("PUBLISH", REDIS_BROADCAST_CHANNEL, data); err != nil {
+		logs.Error("Redis PUBLISH broadcast failed, broadcast locally only. Error: ", err.Error())
+		_BroadcastLocal(this.hub, data)
+	}
+}
+
+func (this *RedisBroker) Online(user string) {
+	c := this.pool.Get()
+	defer c.Close()
+
+	if _, err := c.Do("SADD", fmt.Sprintf(REDIS_USER_KEY, user), this.node); err != nil {
+		logs.Error("Redis SADD user \"%s\" failed. Error: %s", user, err.Error())
+	}
+}
+
+func (this *RedisBroker) Offline(user string) {
+	c := this.pool.Get()
+	defer c.Close()
+
+	if _, err := c.Do("SREM", fmt.Sprintf(REDIS_USER_KEY, user), this.node); err != nil {
+		logs.Error("Redis SREM user \"%s\" failed. Error: %s", user, err.Error())
+	}
+}
+
+func (this *RedisBroker) Locate(user string) []string {
+	c := this.pool.Get()
+	defer c.Close()
+
+	nodes, err := redis.Strings(c.Do("SMEMBERS", fmt.Sprintf(REDIS_USER_KEY, user)))
+	if err != nil {
+		logs.Error("Redis SMEMBERS user \"%s\" failed. Error: %s", user, err.Error())
+		// at least the local devices still get it.
+		if len(this.hub.Lookup(user)) != 0 {
+			return []string{this.node}
+		}
+		return []string{}
+	}
+
+	return nodes
+}
+
+// OnlineUsers walks the user keys, a user key only exists as long as its set
+// of nodes is not empty.
+func (this *RedisBroker) OnlineUsers() []string {
+	c := this.pool.Get()
+	defer c.Close()
+
+	users := make([]string, 0)
+	// SCAN may return a key more than once.
+	seen := make(map[string]bool)
+	prefix := fmt.Sprintf(REDIS_USER_KEY, "")
+	cursor := 0
+	for {
+		values, err := redis.Values(c.Do("SCAN", cursor, "MATCH", prefix+"*", "COUNT", 1000))
+		if err != nil {
+			logs.Error("Redis SCAN user keys failed. Error: ", err.Error())
+			return users
+		}
+		cursor, _ = redis.Int(values[0], nil)
+		keys, _ := redis.Strings(values[1], nil)
+		for _, k := range keys {
+			if !seen[k] {
+				seen[k] = true
+				users = append(users, strings.TrimPrefix(k, prefix))
+			}
+		}
+		if cursor == 0 {
+			return users
+		}
+	}
+}
+
+func (this *RedisBroker) SetPresence(user, status string) string {
+	c := this.pool.Get()
+	defer c.Close()
+
+	old, err := redis.String(g_redis_set_presence.Do(c, REDIS_PRESENCE_KEY, user, status))
+	if err == redis.ErrNil {
+		return PRESENCE_OFFLINE
+	}
+	if err != nil {
+		logs.Error("Redis set presence of user \"%s\" failed. Error: %s", user, err.Error())
+		// nothing changed, nobody is told.
+		return status
+	}
+
+	return old
+}
+
+func (this *RedisBroker) Presence(users []string) map[string]string {
+	r := make(map[string]string)
+	for _, v := range users {
+		r[v] = PRESENCE_OFFLINE
+	}
+	if len(users) == 0 {
+		return r
+	}
+
+	c := this.pool.Get()
+	defer c.Close()
+
+	statuses, err := redis.Strings(c.Do("HMGET", redis.Args{}.Add(REDIS_PRESENCE_KEY).AddFlat(users)...))
+	if err != nil {
+		logs.Error("Redis HMGET presence failed. Error: ", err.Error())
+		return r
+	}
+	for i, v := range statuses {
+		// a missing status is an empty string.
+		if v != "" {
+			r[users[i]] = v
+		}
+	}
+
+	return r
+}
+
+func (this *RedisBroker) PublishPresence(user string, data []byte) {
+	env, err := json.Marshal(Envelope{User: user, Data: data})
+	if err != nil {
+		logs.Error("Envelope Marshal failed. Error: ", err.Error())
+		return
+	}
+
+	c := this.pool.Get()
+	defer c.Close()
+
+	// every node gets it back on REDIS_PRESENCE_CHANNEL, this one too.
+	if _, err := c.Do("PUBLISH", REDIS_PRESENCE_CHANNEL, env); err != nil {
+		logs.Error("Redis PUBLISH presence failed, notify locally only. Error: ", err.Error())
+		_NotifyPresence(this.hub, user, data)
+	}
+}
+
+// _Subscribe receives the envelopes published to this node, the broadcasts
+// and the presence events, it reconnects for as long as the process lives.
+func (this *RedisBroker) _Subscribe() {
+	channel := fmt.Sprintf(REDIS_NODE_CHANNEL, this.node)
+	for {
+		psc := redis.PubSubConn{Conn: this.pool.Get()}
+		if err := psc.Subscribe(channel, REDIS_BROADCAST_CHANNEL, REDIS_PRESENCE_CHANNEL); err != nil {
+			logs.Error("Redis SUBSCRIBE failed. Error: ", err.Error())
+			psc.Close()
+			time.Sleep(REDIS_RETRY_INTERVAL)
+			continue
+		}
+		// re-register the local users, their entries may be dropped while
+		// this node was not listening.
+		for user := range this.hub.Snapshot() {
+			this.Online(user)
+		}
+
+		for is_alive := true; is_alive; {
+			switch v := psc.Receive().(type) {
+			case redis.Message:
+				if v.Channel == REDIS_BROADCAST_CHANNEL {
+					_BroadcastLocal(this.hub, v.Data)
+					break
+				}
+				var env Envelope
+				if err := json.Unmarshal(v.Data, &env); err != nil {
+					logs.Error("Envelope Unmarshal failed. Error: ", err.Error())
+					break
+				}
+				if v.Channel == REDIS_PRESENCE_CHANNEL {
+					_NotifyPresence(this.hub, env.User, env.Data)
+					break
+				}
+				_DeliverLocal(this.hub, env)
+
+			case error:
+				logs.Error("Redis pub/sub connection lost. Error: ", v.Error())
+				is_alive = false
+			}
+		}
+		psc.Close()
+		time.Sleep(REDIS_RETRY_INTERVAL)
+	}
+}
@@ -0,0 +1,169 @@
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gomodule/redigo/redis"
+)
+
+const (
+	TEST_WAIT = 2 * time.Second
+)
+
+// _TestRedisAddr is the redis of CHAT_TEST_REDIS_ADDR, or an in-process one
+// listening on localhost.
+func _TestRedisAddr(t *testing.T) string {
+	if addr := os.Getenv("CHAT_TEST_REDIS_ADDR"); addr != "" {
+		return addr
+	}
+
+	s, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("start redis failed: %v", err)
+	}
+	t.Cleanup(s.Close)
+
+	return s.Addr()
+}
+
+// _NewTestNode starts the broker of node "node" with a hub of its own and
+// waits until it listens on its channels, what a node gets from another one
+// can only come through redis.
+func _NewTestNode(t *testing.T, addr, node string) *RedisBroker {
+	r, err := NewRedisBroker(addr, node, NewHub())
+	if err != nil {
+		t.Fatalf("create redis broker of node %s failed: %v", node, err)
+	}
+
+	c := r.pool.Get()
+	defer c.Close()
+	deadline := time.Now().Add(TEST_WAIT)
+	for {
+		v, err := redis.Values(c.Do("PUBSUB", "NUMSUB", fmt.Sprintf(REDIS_NODE_CHANNEL, node)))
+		if err != nil {
+			t.Fatalf("PUBSUB NUMSUB failed: %v", err)
+		}
+		if n, _ := redis.Int(v[1], nil); n != 0 {
+			return r
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("node %s does NOT listen", node)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// _RegisterTest connects "user" to "node" until the test ends.
+func _RegisterTest(t *testing.T, node *RedisBroker, user string) *Conn {
+	conn := _NewTestConn(16)
+	node.hub.Register(user, conn)
+	node.Online(user)
+	t.Cleanup(func() {
+		node.hub.Unregister(user, conn)
+		node.Offline(user)
+	})
+
+	return conn
+}
+
+func _ReceiveTest(t *testing.T, conn *Conn) []byte {
+	select {
+	case msg := <-conn.send:
+		return msg.msg
+	case <-time.After(TEST_WAIT):
+		t.Fatal("no message received")
+		return nil
+	}
+}
+
+// _NoReceiveTest fails if "conn" gets a message.
+func _NoReceiveTest(t *testing.T, conn *Conn) {
+	select {
+	case msg := <-conn.send:
+		t.Errorf("unexpected message received: %s", msg.msg)
+	case <-time.After(TEST_WAIT / 10):
+	}
+}
+
+func TestRedisBrokerCrossNode(t *testing.T) {
+	addr := _TestRedisAddr(t)
+	node_a := _NewTestNode(t, addr, "test-a")
+	node_b := _NewTestNode(t, addr, "test-b")
+
+	// bob is connected to node b, a device of alice on node a only sees
+	// what is sent to alice.
+	conn := _RegisterTest(t, node_b, "bob")
+	conn_a := _RegisterTest(t, node_a, "alice")
+	if nodes := node_a.Locate("bob"); len(nodes) != 1 || nodes[0] != "test-b" {
+		t.Fatalf("bob located at %v, want [test-b]", nodes)
+	}
+
+	node_a.Publish(Envelope{User: "bob", Data: []byte(`{"msg":"hi"}`), IsEphemeral: true})
+	if got := string(_ReceiveTest(t, conn)); got != `{"msg":"hi"}` {
+		t.Errorf("bob got %s", got)
+	}
+	if conns := node_a.hub.Lookup("bob"); len(conns) != 0 {
+		t.Errorf("bob has %d devices on node a", len(conns))
+	}
+	_NoReceiveTest(t, conn_a)
+
+	users := node_a.OnlineUsers()
+	sort.Strings(users)
+	if len(users) != 2 || users[0] != "alice" || users[1] != "bob" {
+		t.Errorf("online users %v, want [alice bob]", users)
+	}
+
+	node_b.Offline("bob")
+	if nodes := node_a.Locate("bob"); len(nodes) != 0 {
+		t.Errorf("bob located at %v after going offline", nodes)
+	}
+}
+
+func TestRedisBrokerCrossNodePresence(t *testing.T) {
+	addr := _TestRedisAddr(t)
+	node_a := _NewTestNode(t, addr, "test-a")
+	node_b := _NewTestNode(t, addr, "test-b")
+
+	// carol is connected to both nodes and subscribes to dave, dave goes
+	// away on node a.
+	conn := _RegisterTest(t, node_b, "carol")
+	conn_a := _RegisterTest(t, node_a, "carol")
+	g_presence_lock.Lock()
+	g_presence_subs["dave"] = map[string]bool{"carol": true}
+	g_presence_lock.Unlock()
+	defer _DropPresenceSubs("carol")
+
+	if old := node_a.SetPresence("dave", PRESENCE_AWAY); old != PRESENCE_OFFLINE {
+		t.Errorf("old presence %s, want %s", old, PRESENCE_OFFLINE)
+	}
+	data, _ := _Marshal(PresenceEvent{Version: 1, Type: "presence", Event: true, User: "dave", Status: PRESENCE_AWAY})
+	node_a.PublishPresence("dave", data)
+
+	var e PresenceEvent
+	if err := json.Unmarshal(_ReceiveTest(t, conn), &e); err != nil {
+		t.Fatalf("bad presence event: %v", err)
+	}
+	if e.Type != "presence" || e.User != "dave" || e.Status != PRESENCE_AWAY {
+		t.Errorf("carol got %+v", e)
+	}
+	// node a got the event too, its device of carol gets its own copy only.
+	_ReceiveTest(t, conn_a)
+	_NoReceiveTest(t, conn)
+
+	presence := node_b.Presence([]string{"dave", "erin"})
+	if presence["dave"] != PRESENCE_AWAY || presence["erin"] != PRESENCE_OFFLINE {
+		t.Errorf("presence seen from node b: %v", presence)
+	}
+	if old := node_b.SetPresence("dave", PRESENCE_OFFLINE); old != PRESENCE_AWAY {
+		t.Errorf("old presence %s, want %s", old, PRESENCE_AWAY)
+	}
+	if presence := node_a.Presence([]string{"dave"}); presence["dave"] != PRESENCE_OFFLINE {
+		t.Errorf("presence seen from node a: %v", presence)
+	}
+}
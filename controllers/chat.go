@@ -3,37 +3,50 @@ package controllers
 import (
 	"chat_server/models"
 
+	"encoding/json"
 	"fmt"
+	"net"
 	"net/http"
-	"sort"
 	"time"
 
 	"github.com/astaxie/beego"
 	"github.com/astaxie/beego/logs"
 
-	"github.com/bitly/go-simplejson"
 	"github.com/gorilla/websocket"
 )
 
 const (
 	PARSE_JSON_ERR  = 1000
-	MISS_PARAM_ERR  = 1100
+	PARAM_ERR       = 1100
 	CMD_TYPE_ERR    = 1200
 	PERMISSION_ERR  = 1300
 	LOGIN_ERR       = 2000
+	RESUME_ERR      = 2100
+	LOGIN_WAIT_ERR  = 2200
+	USER_LOCKED_ERR = 2300
+	IP_LOCKED_ERR   = 2400
 	ADD_USER_ERR    = 3000
+	UPDATE_USER_ERR = 3100
+	PASSWD_ERR      = 3200
 	DELETE_USER_ERR = 4000
+	CREATE_ROOM_ERR = 5000
+	JOIN_ROOM_ERR   = 5100
+	LEAVE_ROOM_ERR  = 5200
+	RECEIPT_ERR     = 6000
+	API_AUTH_ERR    = 8000
 )
 
-const (
-	WS_READ_BUFFER_SIZE  = 1024
-	WS_WRITE_BUFFER_SIZE = 1024
+var (
+	WS_READ_BUFFER_SIZE  = models.ConfIntMin("ws_read_buffer_size", 1024, 0)
+	WS_WRITE_BUFFER_SIZE = models.ConfIntMin("ws_write_buffer_size", 1024, 0)
+
+	// offline messages older than it are not delivered at login.
+	HISTORY_MSG_DURATION = time.Duration(models.ConfIntMin("history_msg_duration", 3600, 0)) * time.Second
 )
 
-var (
-	//HISTORY_MSG_DURATION = beego.AppConfig.String("history_msg_duration")
-	HISTORY_MSG_DURATION = time.Hour
-	//HISTORY_MSG_DURATION = 5 * time.Minute
+const (
+	// offline messages are replayed at login this many at a time.
+	OFFLINE_REPLAY_PAGE_SIZE = 100
 )
 
 const (
@@ -43,13 +56,24 @@ const (
 
 var (
 	ERR_REPLYS = map[int]string{
-		PARSE_JSON_ERR:  "Message is NOT in JSON format.",
-		MISS_PARAM_ERR:  "Miss parameters in JSON.",
+		PARSE_JSON_ERR:  "Message is NOT in JSON format, or in the format of the negotiated subprotocol.",
+		PARAM_ERR:       "Missing or invalid parameters, see \"errors\".",
 		CMD_TYPE_ERR:    "Unknown command type.",
 		PERMISSION_ERR:  "No user login or the user doesn't have permisson to exec this command.",
 		LOGIN_ERR:       "Login failed. User does NOT exist or password is Wrong.",
+		RESUME_ERR:      "Resume failed. Session token is invalid, expired or revoked.",
+		LOGIN_WAIT_ERR:  "Login refused. Too many failed logins, retry after \"retryafter\" ms.",
+		USER_LOCKED_ERR: "Login refused. The account is locked for too many failed logins.",
+		IP_LOCKED_ERR:   "Login refused. The address is locked out for too many failed logins.",
 		ADD_USER_ERR:    "Add user failed. Maybe user name is duplicated.",
-		DELETE_USER_ERR: "Delete user failed.",
+		UPDATE_USER_ERR: "Update user failed. User does NOT exist, is NOT yours, the new name is duplicated or the type can NOT be granted.",
+		PASSWD_ERR:      "Change password failed. Old password is Wrong.",
+		DELETE_USER_ERR: "Delete user failed. A user is NOT yours, or the user to reassign to is NOT an admin.",
+		CREATE_ROOM_ERR: "Create room failed. Maybe room name is duplicated.",
+		JOIN_ROOM_ERR:   "Join room failed. Room does NOT exist.",
+		LEAVE_ROOM_ERR:  "Leave room failed. User is NOT a member of the room.",
+		RECEIPT_ERR:     "Message does NOT exist or is NOT addressed to the user.",
+		API_AUTH_ERR:    "Service credentials are missing or wrong.",
 	}
 
 	WS_CLOSE_ERROR = []int{
@@ -70,115 +94,119 @@ var (
 	}
 )
 
-var (
-	k_online_users = make(map[string]*websocket.Conn)
-	g_history_msgs = make(map[string]map[int64][]Message)
-)
-
 type ChatController struct {
 	beego.Controller
 
 	cur_cmd       string
+	cur_req_id    ReqId
 	cur_user_id   int64
 	cur_user      string
 	cur_user_type int
-	ws            *websocket.Conn
-	reply_json    *simplejson.Json
-	body_json     *simplejson.Json
+	cur_token     string
+	conn          *Conn
+	body_fields   map[string]json.RawMessage
 }
 
 func (this *ChatController) ErrReply(err_code int) {
-	j := simplejson.New()
-	j.Set("type", this.cur_cmd)
-	j.Set("code", err_code)
-	j.Set("reason", ERR_REPLYS[err_code])
+	this.Reply(ErrorReply{Type: this.cur_cmd, Id: this.cur_req_id, Code: err_code, Reason: ERR_REPLYS[err_code]})
+}
 
-	this.Reply(j)
+// ParamErrReply tells the client which fields of its request are missing
+// or invalid.
+func (this *ChatController) ParamErrReply(errs []FieldError) {
+	this.Reply(ErrorReply{Type: this.cur_cmd, Id: this.cur_req_id, Code: PARAM_ERR, Reason: ERR_REPLYS[PARAM_ERR], Errors: errs})
 }
 
-func (this *ChatController) Reply(j *simplejson.Json) {
-	if this.ws != nil {
-		data, err := j.MarshalJSON()
+func (this *ChatController) Reply(v interface{}) {
+	if this.conn != nil {
+		data, err := _Marshal(v)
 		if err != nil {
 			logs.Error("MarshalJSON failed.")
-		} else {
-			err := this.ws.WriteMessage(websocket.TextMessage, data)
-			if err != nil {
-				logs.Error("Command \"%s\" Response Faild. Error: ", err.Error())
-			}
+		} else if !this.conn.Send(Message{receiver: this.cur_user, msg: data}) {
+			logs.Error("Command \"%s\" Response Faild.", this.cur_cmd)
 		}
 	} else {
 		logs.Error("Current connetion is lost.")
 	}
 }
 
-func (this *ChatController) SendMsg(j *simplejson.Json, unix_ns int64, receivers []string) {
-	data, err := j.MarshalJSON()
+func (this *ChatController) SendMsg(v interface{}, unix_ns int64, receivers []string) {
+	_Publish(v, unix_ns, receivers)
+}
+
+// _Publish delivers "v" to the receivers wherever they are connected, the
+// offline ones get it at their next login.
+func _Publish(v interface{}, unix_ns int64, receivers []string) {
+	data, err := _Marshal(v)
 	if err != nil {
 		logs.Error("SendMsg MarshalJSON failed. Error: ", err.Error())
 		panic(err)
 	}
 	for _, v := range receivers {
-		if conn, ok := k_online_users[v]; ok {
-			K_Msgs <- Message{receiver: v, msg: data, conn: conn}
-		} else {
-			if _, ok := g_history_msgs[v]; !ok {
-				g_history_msgs[v] = make(map[int64][]Message)
-			}
-			g_history_msgs[v][unix_ns] = append(g_history_msgs[v][unix_ns], Message{receiver: v, msg: data, conn: nil})
-		}
+		K_Broker.Publish(Envelope{User: v, Data: data, UnixNs: unix_ns})
 	}
 }
 
-type _Times []int64
-
-func (t _Times) Len() int           { return len(t) }
-func (t _Times) Swap(i, j int)      { t[i], t[j] = t[j], t[i] }
-func (t _Times) Less(i, j int) bool { return t[i] < t[j] }
-
-func (this *ChatController) SendHistoryMsg(cur_unix_ns, hour_ago_unix_ns int64) {
-	history_msgs, ok := g_history_msgs[this.cur_user]
-	if !ok {
+// SendMirror copies a message the current user sent to the other devices of
+// the user, so that they all show the same conversations.
+func (this *ChatController) SendMirror(v interface{}) {
+	data, err := _Marshal(v)
+	if err != nil {
+		logs.Error("SendMirror MarshalJSON failed. Error: ", err.Error())
 		return
 	}
+	K_Broker.Publish(Envelope{User: this.cur_user, Data: data, IsEphemeral: true, SkipConn: this.conn.id})
+}
 
-	var times _Times
-	for t, _ := range history_msgs {
-		if t >= hour_ago_unix_ns && t < cur_unix_ns {
-			times = append(times, t)
-		} else {
-			delete(history_msgs, t)
-		}
+// _SendOnline delivers "data" to the receivers which are online right now,
+// the others never get it.
+func _SendOnline(data []byte, receivers []string) {
+	for _, v := range receivers {
+		K_Broker.Publish(Envelope{User: v, Data: data, IsEphemeral: true})
 	}
-	sort.Sort(times)
+}
 
-	for _, t := range times {
-		for _, m := range history_msgs[t] {
-			m.conn = this.ws
-			K_Msgs <- m
+// SendHistoryMsg replays the offline messages of the current user a page at
+// a time. It waits for the client to drain half of the queue rather than
+// filling it, so live messages still fit, and deletes the rows of what it queued, a queued message
+// the client doesn't get goes back to the offline store.
+func (this *ChatController) SendHistoryMsg(cur_unix_ns, hour_ago_unix_ns int64) {
+	var after_id int64
+	for {
+		msgs, last_id := models.LoadOfflineMsgs(this.cur_user, hour_ago_unix_ns, cur_unix_ns, after_id, OFFLINE_REPLAY_PAGE_SIZE)
+		if last_id == 0 {
+			return
+		}
+		queued_id := after_id
+		for _, m := range msgs {
+			if !this.conn.SendWait(Message{receiver: this.cur_user, msg: m.Payload, is_durable: true, unix_ns: m.UnixNs}, WS_WRITE_WAIT) {
+				// the rest are kept for the next login.
+				models.DeleteOfflineMsgs(this.cur_user, queued_id)
+				return
+			}
+			queued_id = m.Id
 		}
-		delete(history_msgs, t)
-	}
 
-	delete(g_history_msgs, this.cur_user)
+		models.DeleteOfflineMsgs(this.cur_user, last_id)
+		after_id = last_id
+	}
 }
 
-func (this *ChatController) Broadcast(j *simplejson.Json) {
-	data, err := j.MarshalJSON()
+func (this *ChatController) Broadcast(v interface{}) {
+	data, err := _Marshal(v)
 	if err != nil {
 		logs.Error("Broadcast MarshalJSON failed. Error: ", err.Error())
 		panic(err)
 	}
-	for k, v := range k_online_users {
-		K_Msgs <- Message{receiver: k, msg: data, conn: v}
-	}
+	K_Broker.Broadcast(data)
 }
 
 // @router / [get]
 func (this *ChatController) WSConnect() {
 
 	// Upgrade from http request to WebSocket.
-	ws, err := websocket.Upgrade(this.Ctx.ResponseWriter, this.Ctx.Request, nil, WS_READ_BUFFER_SIZE, WS_WRITE_BUFFER_SIZE)
+	codec, header := _NegotiateCodec(this.Ctx.Request)
+	ws, err := websocket.Upgrade(this.Ctx.ResponseWriter, this.Ctx.Request, header, WS_READ_BUFFER_SIZE, WS_WRITE_BUFFER_SIZE)
 	if _, ok := err.(websocket.HandshakeError); ok {
 		http.Error(this.Ctx.ResponseWriter, "Not a websocket handshake", 400)
 		return
@@ -186,26 +214,28 @@ func (this *ChatController) WSConnect() {
 		logs.Error("Cannot setup WebSocket connection:", err)
 		return
 	}
-	this.ws = ws
+	this.conn = NewConn(ws, codec)
 	this.cur_cmd = ""
 	this.cur_user = ""
 	this.cur_user_type = models.USER_NORMAL_TYPE
 
+	defer func() {
+		this._GoOffline()
+		this.conn.Close()
+		this.conn = nil
+	}()
+
 	// Message receive loop.
 	var err_num = 0
 	for {
-
-		defer func() {
-			delete(k_online_users, this.cur_user)
-			ws.Close()
-			this.ws = nil
-
-		}()
-
 		_, body, err := ws.ReadMessage()
 		if err != nil {
 			if websocket.IsCloseError(err, WS_CLOSE_ERROR...) {
-				logs.Error("Close Error: %s, cur_user: %s, cur_user_type: %d, conn: %p", err.Error(), this.cur_user, this.cur_user_type, this.ws)
+				logs.Error("Close Error: %s, cur_user: %s, cur_user_type: %d, conn: %p", err.Error(), this.cur_user, this.cur_user_type, this.conn)
+				return
+			}
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				logs.Warning("Reap dead or idle connection, cur_user: %s, conn: %p", this.cur_user, this.conn)
 				return
 			}
 			logs.Error("Read msg faled from WebSocket. Error:", err.Error())
@@ -216,18 +246,31 @@ func (this *ChatController) WSConnect() {
 			continue
 		}
 		err_num = 0
+		this.conn.Touch()
 
-		this.body_json, err = simplejson.NewJson(body)
+		this.cur_cmd = ""
+		this.cur_req_id = nil
+		this.body_fields = nil
+		this.body_fields, err = this.conn.codec.Decode(body)
 		if err != nil {
-			logs.Error("Request Body is NOT in JSON format. Error:", err.Error())
+			logs.Error("Request Body is NOT in %s format. Error: %s", this.conn.codec.Name(), err.Error())
 			this.ErrReply(PARSE_JSON_ERR)
 			continue
 		}
 
-		this.cur_cmd, err = this._Parse()
-		if err != nil {
-			logs.Error("Miss parameter \"type\" in Json body. Error:", err.Error())
-			this.ErrReply(MISS_PARAM_ERR)
+		// whatever of the header decodes fine is echoed, even in the error
+		// reply about the rest of it.
+		var cmd CmdReq
+		errs := _DecodeFields(this.body_fields, &cmd)
+		this.cur_cmd = cmd.Type
+		this.cur_req_id = cmd.Id
+		if len(errs) != 0 {
+			logs.Error("Invalid command header: %v", errs)
+			this.ParamErrReply(errs)
+			continue
+		}
+		if err_code := this._Authorize(); err_code != 0 {
+			this.ErrReply(err_code)
 			continue
 		}
 
@@ -235,9 +278,27 @@ func (this *ChatController) WSConnect() {
 		case "login":
 			this._Login()
 
+		case "resume":
+			this._Resume()
+
+		case "logout":
+			this._Logout()
+
 		case "adduser":
 			this._AddUser()
 
+		case "updateuser":
+			this._UpdateUser()
+
+		case "passwd":
+			this._Passwd()
+
+		case "listlocked":
+			this._ListLocked()
+
+		case "unlock":
+			this._Unlock()
+
 		case "deluser":
 			this._DeleteUser()
 
@@ -247,6 +308,42 @@ func (this *ChatController) WSConnect() {
 		case "sendmsg":
 			this._SendMsg()
 
+		case "createroom":
+			this._CreateRoom()
+
+		case "joinroom":
+			this._JoinRoom()
+
+		case "leaveroom":
+			this._LeaveRoom()
+
+		case "listrooms":
+			this._ListRooms()
+
+		case "history":
+			this._History()
+
+		case "ack":
+			this._Ack()
+
+		case "markread":
+			this._MarkRead()
+
+		case "typing_start":
+			this._TypingStart()
+
+		case "typing_stop":
+			this._TypingStop()
+
+		case "setpresence":
+			this._SetPresenceStatus()
+
+		case "subscribepresence":
+			this._SubscribePresence()
+
+		case "unsubscribepresence":
+			this._UnsubscribePresence()
+
 		default:
 			logs.Error("Unknown cmd: ", this.cur_cmd)
 			this.ErrReply(CMD_TYPE_ERR)
@@ -254,144 +351,300 @@ func (this *ChatController) WSConnect() {
 	}
 }
 
-func (this *ChatController) _Parse() (string, error) {
-	cmd, err := this.body_json.Get("type").String()
-	if err != nil {
-		return "", err
+// _Decode decodes the current request into "v", on failure it replies the
+// field errors itself.
+func (this *ChatController) _Decode(v interface{}) bool {
+	errs := _DecodeFields(this.body_fields, v)
+	if len(errs) != 0 {
+		logs.Error("Invalid parameters of cmd \"%s\": %v", this.cur_cmd, errs)
+		this.ParamErrReply(errs)
+		return false
 	}
 
-	return cmd, nil
+	return true
 }
 
 func (this *ChatController) _Login() {
-	name := this.body_json.Get("name").MustString()
-	password := this.body_json.Get("password").MustString()
+	var req LoginReq
+	if !this._Decode(&req) {
+		return
+	}
 
-	if id, user_type := models.UserLogin(name, password); id != 0 {
-		this.cur_user = name
+	ip := _RemoteIP(this.Ctx.Request)
+	if err_code, wait := _CheckLogin(req.Name, ip); err_code != 0 {
+		logs.Warning("Login of user \"%s\" from %s refused, code: %d, wait: %s", req.Name, ip, err_code, wait)
+		this.Reply(ErrorReply{
+			Type:       this.cur_cmd,
+			Id:         this.cur_req_id,
+			Code:       err_code,
+			Reason:     ERR_REPLYS[err_code],
+			RetryAfter: int64(wait / time.Millisecond),
+		})
+		return
+	}
+
+	if id, user_type := models.UserLogin(req.Name, req.Password); id != 0 {
+		_LoginSucceeded(req.Name)
+		this._GoOffline()
+		this.cur_user = req.Name
 		this.cur_user_type = user_type
 		this.cur_user_id = id
-		j := this._ConstructReplyJson()
-		j.Set("usertype", user_type)
-		this.Reply(j)
 
-		// update online conn
-		if _, ok := k_online_users[this.cur_user]; ok {
-			k_online_users[this.cur_user].Close()
-		}
-		k_online_users[this.cur_user] = this.ws
+		token, expires_at := models.CreateSession(id)
+		this.cur_token = token
 
-		// send welcome msg
-		//j, _ = this._ConstructMsgJson(_WelcomMsg(name))
-		//this.Broadcast(j)
+		reply := LoginReply{ReplyHeader: this._ReplyHeader(), UserType: user_type, Role: models.RoleOf(user_type)}
+		if token != "" {
+			reply.Token = token
+			reply.Expires = _UnixMs(expires_at)
+		}
+		this.Reply(reply)
 
-		// send history msgs to current user
-		cur_unix_ns := time.Now().UnixNano()
-		hour_ago_unix_ns := cur_unix_ns - int64(HISTORY_MSG_DURATION)
-		this.SendHistoryMsg(cur_unix_ns, hour_ago_unix_ns)
+		this._GoOnline()
 	} else {
+		_LoginFailed(req.Name, ip)
 		this.ErrReply(LOGIN_ERR)
 	}
 }
 
-func (this *ChatController) _AddUser() {
-	if this.cur_user == "" || this.cur_user_type >= models.USER_NORMAL_TYPE {
-		this.ErrReply(PERMISSION_ERR)
+func (this *ChatController) _Resume() {
+	var req ResumeReq
+	if !this._Decode(&req) {
 		return
 	}
 
-	name := this.body_json.Get("name").MustString()
-	password := this.body_json.Get("password").MustString()
+	if id, name, user_type := models.ResumeSession(req.Token); id != 0 {
+		this._GoOffline()
+		this.cur_user = name
+		this.cur_user_type = user_type
+		this.cur_user_id = id
+		this.cur_token = req.Token
+
+		this.Reply(LoginReply{ReplyHeader: this._ReplyHeader(), Name: name, UserType: user_type, Role: models.RoleOf(user_type)})
+
+		this._GoOnline()
+	} else {
+		this.ErrReply(RESUME_ERR)
+	}
+}
+
+func (this *ChatController) _Logout() {
+	if this.cur_token != "" {
+		models.RevokeSession(this.cur_token)
+	}
+
+	this.Reply(this._ReplyHeader())
 
-	if id := models.AddUser(this.cur_user_id, this.cur_user_type, name, password); id != 0 {
-		j := this._ConstructReplyJson()
-		this.Reply(j)
+	this._GoOffline()
+	this.cur_user = ""
+	this.cur_user_id = 0
+	this.cur_user_type = models.USER_NORMAL_TYPE
+	this.cur_token = ""
+}
+
+// _GoOnline registers the connection of the freshly authenticated user and
+// replays what the user missed while offline.
+func (this *ChatController) _GoOnline() {
+	// update online conn
+	if K_Hub.Register(this.cur_user, this.conn) {
+		K_Broker.Online(this.cur_user)
+		// the user may be online, or away, on another node already.
+		if K_Broker.Presence([]string{this.cur_user})[this.cur_user] == PRESENCE_OFFLINE {
+			_SetPresence(this.cur_user, PRESENCE_ONLINE)
+		}
+	}
+
+	// send welcome msg
+	//e, _ := _NewMsgEvent(name, "", _WelcomMsg(name))
+	//this.Broadcast(e)
+
+	// send history msgs to current user
+	cur_unix_ns := time.Now().UnixNano()
+	hour_ago_unix_ns := cur_unix_ns - int64(HISTORY_MSG_DURATION)
+	this.SendHistoryMsg(cur_unix_ns, hour_ago_unix_ns)
+}
+
+// _GoOffline unregisters the connection of the current user, the user goes
+// offline with the last of its devices in the cluster.
+func (this *ChatController) _GoOffline() {
+	if K_Hub.Unregister(this.cur_user, this.conn) {
+		K_Broker.Offline(this.cur_user)
+		_DropPresenceSubs(this.cur_user)
+		if len(K_Broker.Locate(this.cur_user)) == 0 {
+			_SetPresence(this.cur_user, PRESENCE_OFFLINE)
+		}
+	}
+}
+
+func (this *ChatController) _AddUser() {
+	var req AddUserReq
+	if !this._Decode(&req) {
+		return
+	}
+
+	if id := models.AddUser(this.cur_user_id, this.cur_user_type, req.Name, req.Password); id != 0 {
+		this.Reply(this._ReplyHeader())
 	} else {
 		this.ErrReply(ADD_USER_ERR)
 	}
 }
 
 func (this *ChatController) _DeleteUser() {
-	if this.cur_user == "" || this.cur_user_type >= models.USER_NORMAL_TYPE {
-		this.ErrReply(PERMISSION_ERR)
+	var req DeleteUserReq
+	if !this._Decode(&req) {
 		return
 	}
-
-	var users []string = nil
-	is_remove_all := this.body_json.Get("removeall").MustBool()
-	if !is_remove_all {
-		users = this.body_json.Get("users").MustStringArray()
-		if len(users) == 0 {
-			logs.Error("\"users\" array is empty.")
-			this.ErrReply(MISS_PARAM_ERR)
-			return
-		}
+	if req.RemoveAll {
+		req.Users = nil
 	}
 
-	if models.DeleteUser(this.cur_user_id, this.cur_user_type, users, is_remove_all) {
-		j := this._ConstructReplyJson()
-		this.Reply(j)
-	} else {
+	deleted, reassigned, ok := models.DeleteUser(this.cur_user_id, this.cur_user_type, req.Users, req.RemoveAll, req.Mode, req.ReassignTo)
+	if !ok {
 		this.ErrReply(DELETE_USER_ERR)
+		return
+	}
+
+	this.Reply(DeleteUserReply{
+		ReplyHeader: this._ReplyHeader(),
+		Deleted:     len(deleted),
+		Reassigned:  reassigned,
+		Affected:    len(deleted) + reassigned,
+	})
+
+	// their sessions are gone already, so are their connections now.
+	for _, v := range deleted {
+		K_Broker.Publish(Envelope{User: v, IsKick: true, IsEphemeral: true})
 	}
 }
 
-func (this *ChatController) _ListUser() {
-	if this.cur_user == "" || this.cur_user_type >= models.USER_NORMAL_TYPE {
-		this.ErrReply(PERMISSION_ERR)
+func (this *ChatController) _UpdateUser() {
+	var req UpdateUserReq
+	if !this._Decode(&req) {
 		return
 	}
 
-	start := this.body_json.Get("start").MustInt()
-	length := this.body_json.Get("length").MustInt()
+	new_type := models.USER_TYPE_UNCHANGED
+	if req.UserType != nil {
+		new_type = *req.UserType
+	}
+	if !models.UpdateUser(this.cur_user_id, this.cur_user_type, req.Name, req.NewName, new_type, req.Password) {
+		this.ErrReply(UPDATE_USER_ERR)
+		return
+	}
 
-	users := models.ListUser(this.cur_user_id, start, length)
-	j := this._ConstructReplyJson()
-	j.Set("users", users)
-	this.Reply(j)
+	this.Reply(this._ReplyHeader())
+
+	// the devices of the user go by its old name, type and password, they
+	// have to log in or resume again.
+	K_Broker.Publish(Envelope{User: req.Name, IsKick: true, IsEphemeral: true})
+}
+
+func (this *ChatController) _Passwd() {
+	var req PasswdReq
+	if !this._Decode(&req) {
+		return
+	}
+
+	if !models.ChangePassword(this.cur_user_id, req.OldPassword, req.Password, this.cur_token) {
+		this.ErrReply(PASSWD_ERR)
+		return
+	}
+	this.Reply(this._ReplyHeader())
+
+	// the other devices of the user got in with the old password, they have
+	// to log in again.
+	K_Broker.Publish(Envelope{User: this.cur_user, IsKick: true, IsEphemeral: true, SkipConn: this.conn.id})
+}
+
+func (this *ChatController) _ListUser() {
+	var req PageReq
+	if !this._Decode(&req) {
+		return
+	}
+
+	users := models.ListUser(this.cur_user_id, req.Start, req.Length)
+	this.Reply(UsersReply{ReplyHeader: this._ReplyHeader(), Users: users})
 }
 
 func (this *ChatController) _SendMsg() {
-	if this.cur_user == "" /*|| this.cur_user_type >= models.USER_NORMAL_TYPE*/ {
-		this.ErrReply(PERMISSION_ERR)
+	var req SendMsgReq
+	if !this._Decode(&req) {
 		return
 	}
 
-	receivers := this.body_json.Get("receivers").MustStringArray()
-	if len(receivers) == 0 {
-		logs.Error("\"receivers\" array is empty.")
-		this.ErrReply(MISS_PARAM_ERR)
+	receivers, ok := this._Receivers(req.TargetReq)
+	if !ok {
 		return
 	}
-	msg := this.body_json.Get("msg").MustString()
 
-	j := this._ConstructReplyJson()
-	this.Reply(j)
+	e, unix_ns := _NewMsgEvent(this.cur_user, req.Room, req.Msg)
+	_SaveMsgEvent(e, unix_ns, receivers)
+
+	this.Reply(SendMsgReply{ReplyHeader: this._ReplyHeader(), MsgId: e.MsgId, Timestamp: e.Timestamp})
+
+	this.SendMsg(e, unix_ns, receivers)
 
-	j, unix_ns := this._ConstructMsgJson(msg)
-	this.SendMsg(j, unix_ns, receivers)
+	if req.Room == "" {
+		e.Receivers = receivers
+	}
+	this.SendMirror(e)
 }
 
-func (this *ChatController) _ConstructReplyJson() *simplejson.Json {
-	j := simplejson.New()
-	j.Set("version", 1)
-	j.Set("code", 0)
-	j.Set("type", this.cur_cmd)
+// _Receivers resolves the receivers a request addresses, on failure it
+// replies the error itself.
+func (this *ChatController) _Receivers(target TargetReq) ([]string, bool) {
+	if target.Room == "" {
+		return target.Receivers, true
+	}
+
+	receivers, ok := this._RoomReceivers(target.Room)
+	if !ok {
+		logs.Error("User \"%s\" is NOT a member of room \"%s\".", this.cur_user, target.Room)
+		this.ErrReply(PERMISSION_ERR)
+		return nil, false
+	}
 
-	return j
+	return receivers, true
 }
 
-func (this *ChatController) _ConstructMsgJson(msg string) (*simplejson.Json, int64) {
-	j := simplejson.New()
-	j.Set("version", 1)
-	j.Set("sender", this.cur_user)
-	j.Set("type", "recvmsg")
-	j.Set("msg", msg)
+func (this *ChatController) _ReplyHeader() ReplyHeader {
+	return ReplyHeader{Version: 1, Code: 0, Type: this.cur_cmd, Id: this.cur_req_id}
+}
 
+func _NewMsgEvent(sender, room, msg string) (*RecvMsgEvent, int64) {
 	unix_ns := time.Now().UnixNano()
-	//j.Set("timestamp", unix_ns)
 
-	return j, unix_ns
+	e := &RecvMsgEvent{
+		Version:   1,
+		Type:      "recvmsg",
+		Event:     true,
+		Sender:    sender,
+		Msg:       msg,
+		MsgId:     _NewMsgId(),
+		Timestamp: _UnixMs(unix_ns),
+		Room:      room,
+	}
+
+	return e, unix_ns
+}
+
+// _NewServiceMsgEvent is a message of the backend service "service", it's
+// never taken for one of a user.
+func _NewServiceMsgEvent(service, room, msg string) (*RecvMsgEvent, int64) {
+	e, unix_ns := _NewMsgEvent("", room, msg)
+	e.Service = service
+
+	return e, unix_ns
+}
+
+// _SaveMsgEvent keeps "e" in the history, once for its room or once per
+// receiver.
+func _SaveMsgEvent(e *RecvMsgEvent, unix_ns int64, receivers []string) {
+	sender := e.Sender
+	if e.Service != "" {
+		sender = models.SERVICE_SENDER_PREFIX + e.Service
+	}
+	models.SaveMsg(e.MsgId, sender, receivers, e.Room, e.Msg, unix_ns)
 }
 
 func _WelcomMsg(name string) string {
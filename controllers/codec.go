@@ -0,0 +1,151 @@
+package controllers
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/websocket"
+	"github.com/vmihailenco/msgpack/v4"
+)
+
+const (
+	CODEC_JSON    = "chat.json"
+	CODEC_MSGPACK = "chat.msgpack"
+)
+
+var (
+	K_Codecs = map[string]Codec{
+		CODEC_JSON:    JSONCodec{},
+		CODEC_MSGPACK: MsgpackCodec{},
+	}
+	// the subprotocols offered at upgrade, in the order of preference.
+	WS_SUBPROTOCOLS = []string{CODEC_MSGPACK, CODEC_JSON}
+)
+
+// Codec is the encoding of a connection, negotiated at upgrade through
+// Sec-WebSocket-Protocol. Inside the server every message is JSON, a Codec
+// only translates at the edge, so the handlers, the broker and the offline
+// store are the same whatever the client speaks.
+type Codec interface {
+	Name() string
+	// FrameType is the websocket message type the messages are sent in.
+	FrameType() int
+	// Decode splits a request into its fields, each one as JSON.
+	Decode(data []byte) (map[string]json.RawMessage, error)
+	// Encode translates a JSON message into the wire format.
+	Encode(data []byte) ([]byte, error)
+}
+
+// _NegotiateCodec picks the codec of a connection from the subprotocols the
+// client offers, and returns the response header accepting it. A client
+// which offers none speaks JSON as it always did.
+func _NegotiateCodec(r *http.Request) (Codec, http.Header) {
+	offered := websocket.Subprotocols(r)
+	for _, name := range WS_SUBPROTOCOLS {
+		for _, v := range offered {
+			if v == name {
+				return K_Codecs[name], http.Header{"Sec-Websocket-Protocol": {name}}
+			}
+		}
+	}
+
+	return JSONCodec{}, nil
+}
+
+// _Marshal encodes a reply or an event into the internal form, it's what
+// the broker routes and the offline store keeps.
+func _Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+type JSONCodec struct{}
+
+func (this JSONCodec) Name() string {
+	return CODEC_JSON
+}
+
+func (this JSONCodec) FrameType() int {
+	return websocket.TextMessage
+}
+
+func (this JSONCodec) Decode(data []byte) (map[string]json.RawMessage, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+
+	return fields, nil
+}
+
+func (this JSONCodec) Encode(data []byte) ([]byte, error) {
+	return data, nil
+}
+
+// MsgpackCodec speaks MessagePack in binary frames, a message is a map with
+// the same keys and values as its JSON form.
+type MsgpackCodec struct{}
+
+func (this MsgpackCodec) Name() string {
+	return CODEC_MSGPACK
+}
+
+func (this MsgpackCodec) FrameType() int {
+	return websocket.BinaryMessage
+}
+
+func (this MsgpackCodec) Decode(data []byte) (map[string]json.RawMessage, error) {
+	var m map[string]interface{}
+	if err := msgpack.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+
+	fields := make(map[string]json.RawMessage, len(m))
+	for k, v := range m {
+		raw, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		fields[k] = raw
+	}
+
+	return fields, nil
+}
+
+func (this MsgpackCodec) Encode(data []byte) ([]byte, error) {
+	d := json.NewDecoder(bytes.NewReader(data))
+	// keep the integers integers, e.g. timestamps and cursors.
+	d.UseNumber()
+
+	var v interface{}
+	if err := d.Decode(&v); err != nil {
+		return nil, err
+	}
+
+	return msgpack.Marshal(_FromJSONNumbers(v))
+}
+
+// _FromJSONNumbers replaces the json.Number in "v" with int64, or float64
+// if it's not an integer.
+func _FromJSONNumbers(v interface{}) interface{} {
+	switch t := v.(type) {
+	case json.Number:
+		if i, err := t.Int64(); err == nil {
+			return i
+		}
+		f, _ := t.Float64()
+		return f
+
+	case map[string]interface{}:
+		for k, e := range t {
+			t[k] = _FromJSONNumbers(e)
+		}
+
+	case []interface{}:
+		for i, e := range t {
+			t[i] = _FromJSONNumbers(e)
+		}
+	}
+
+	return v
+}
@@ -0,0 +1,227 @@
+package controllers
+
+import (
+	"chat_server/models"
+
+	"sync"
+	"time"
+
+	"github.com/astaxie/beego/logs"
+	"github.com/gorilla/websocket"
+)
+
+var (
+	// outbound messages a connection may have pending before it is taken
+	// as a slow consumer and evicted.
+	CONN_SEND_QUEUE_SIZE = models.ConfIntMin("conn_send_queue_size", 256, 1)
+	// how often SendWait looks whether the client drained the queue.
+	CONN_DRAIN_POLL = 10 * time.Millisecond
+
+	// time allowed to write a message or a ping to the client.
+	WS_WRITE_WAIT = time.Duration(models.ConfIntMin("ws_write_wait", 10, 1)) * time.Second
+	// time allowed to read the next pong or message from the client.
+	WS_PONG_WAIT = time.Duration(models.ConfIntMin("ws_pong_wait", 60, 1)) * time.Second
+	// pings are sent with this period, it must be less than WS_PONG_WAIT.
+	WS_PING_PERIOD = time.Duration(models.ConfIntMin("ws_ping_period", 50, 1)) * time.Second
+	// a client which only answers pings but sends no command for this long
+	// is disconnected, 0 disables it.
+	WS_IDLE_TIMEOUT = time.Duration(models.ConfIntMin("ws_idle_timeout", 600, 0)) * time.Second
+)
+
+func init() {
+	if WS_PING_PERIOD >= WS_PONG_WAIT {
+		logs.Error("Setting \"ws_ping_period\" must be less than \"ws_pong_wait\", use 9/10 of it.")
+		WS_PING_PERIOD = WS_PONG_WAIT * 9 / 10
+	}
+}
+
+// Conn owns the writing side of a websocket connection. Every write goes
+// through its queue and is done by its own writer goroutine, so a stalled
+// client only ever blocks itself.
+type Conn struct {
+	id     string
+	ws     *websocket.Conn
+	codec  Codec
+	send   chan Message
+	closed chan struct{}
+	once   sync.Once
+
+	// only touched by the reader goroutine.
+	last_active time.Time
+}
+
+func NewConn(ws *websocket.Conn, codec Codec) *Conn {
+	r := new(Conn)
+	r.id = _NewMsgId()
+	r.ws = ws
+	r.codec = codec
+	r.send = make(chan Message, CONN_SEND_QUEUE_SIZE)
+	r.closed = make(chan struct{})
+
+	r.ws.SetPongHandler(func(string) error {
+		return r.ws.SetReadDeadline(r._ReadDeadline())
+	})
+	r.Touch()
+
+	go r._WriteLoop()
+
+	return r
+}
+
+// Touch marks the client active, it's called by the reader goroutine for
+// every message it gets.
+func (this *Conn) Touch() {
+	this.last_active = time.Now()
+	if err := this.ws.SetReadDeadline(this._ReadDeadline()); err != nil {
+		logs.Error("SetReadDeadline failed, conn: %p, Error: %s", this, err.Error())
+	}
+}
+
+// _ReadDeadline is the next pong at the latest, or the end of the idle
+// timeout if that comes first.
+func (this *Conn) _ReadDeadline() time.Time {
+	deadline := time.Now().Add(WS_PONG_WAIT)
+	if WS_IDLE_TIMEOUT > 0 {
+		if idle := this.last_active.Add(WS_IDLE_TIMEOUT); idle.Before(deadline) {
+			deadline = idle
+		}
+	}
+
+	return deadline
+}
+
+// Send queues "msg" without blocking. It returns false if the connection is
+// closed, or gets closed because its queue is full, so the caller can keep
+// the message for later. Once queued, a durable message the client doesn't
+// get goes back to the offline store.
+func (this *Conn) Send(msg Message) bool {
+	select {
+	case <-this.closed:
+		return false
+	default:
+	}
+
+	select {
+	case this.send <- msg:
+		this._SpillIfClosed()
+		return true
+	default:
+		logs.Warning("Slow consumer evicted, To: %s, conn: %p, queued: %d", msg.receiver, this, len(this.send))
+		this.Close()
+		return false
+	}
+}
+
+// SendWait queues "msg" as Send does, but only into the first half of the
+// queue, the other half is left to the live messages so they don't evict
+// the connection. It waits up to "timeout" for the client to drain the
+// queue below half before it evicts the connection.
+func (this *Conn) SendWait(msg Message, timeout time.Duration) bool {
+	limit := cap(this.send) - cap(this.send)/2
+	deadline := time.Now().Add(timeout)
+	for len(this.send) >= limit {
+		if time.Now().After(deadline) {
+			logs.Warning("Slow consumer evicted, To: %s, conn: %p, queued: %d", msg.receiver, this, len(this.send))
+			this.Close()
+			return false
+		}
+		select {
+		case <-this.closed:
+			return false
+		case <-time.After(CONN_DRAIN_POLL):
+		}
+	}
+
+	return this.Send(msg)
+}
+
+// Close closes the websocket, the reader of it then fails and runs the
+// usual disconnect cleanup. It's safe to call it more than once.
+func (this *Conn) Close() {
+	this.once.Do(func() {
+		close(this.closed)
+		this.ws.Close()
+	})
+}
+
+func (this *Conn) _WriteLoop() {
+	ticker := time.NewTicker(WS_PING_PERIOD)
+	defer ticker.Stop()
+	// the connection is closed when the loop ends.
+	defer this._Spill()
+
+	for {
+		select {
+		case msg := <-this.send:
+			logs.Debug("Send Message %s To: %s, conn: %p", string(msg.msg), msg.receiver, this)
+			data, err := this.codec.Encode(msg.msg)
+			if err != nil {
+				logs.Error("Encode Message Failed, Msg: %s, To: %s, codec: %s, Error: %s", string(msg.msg), msg.receiver, this.codec.Name(), err.Error())
+				// storing it for a retry wouldn't help.
+				_DeliveredMessage(msg)
+				continue
+			}
+			this.ws.SetWriteDeadline(time.Now().Add(WS_WRITE_WAIT))
+			err = this.ws.WriteMessage(this.codec.FrameType(), data)
+			if err != nil {
+				logs.Error("Send Message Failed, Msg: %s, To: %s, conn: %p, Error: %s", string(msg.msg), msg.receiver, this, err.Error())
+				this.Close()
+				_SpillMessage(msg)
+				return
+			}
+			_DeliveredMessage(msg)
+
+		case <-ticker.C:
+			this.ws.SetWriteDeadline(time.Now().Add(WS_WRITE_WAIT))
+			err := this.ws.WriteMessage(websocket.PingMessage, nil)
+			if err != nil {
+				logs.Error("Send Ping Failed, conn: %p, Error: %s", this, err.Error())
+				this.Close()
+				return
+			}
+
+		case <-this.closed:
+			return
+		}
+	}
+}
+
+// _SpillIfClosed spills the queue if the connection got closed while a
+// message was being queued, the writer may have spilled it already.
+func (this *Conn) _SpillIfClosed() {
+	select {
+	case <-this.closed:
+		this._Spill()
+	default:
+	}
+}
+
+// _Spill moves the messages left in the queue of a closed connection to the
+// offline store, so the user gets them at the next login.
+func (this *Conn) _Spill() {
+	for {
+		select {
+		case msg := <-this.send:
+			_SpillMessage(msg)
+		default:
+			return
+		}
+	}
+}
+
+// _SpillMessage stores a durable message the client didn't get, unless
+// another device of the user got a copy of it.
+func _SpillMessage(msg Message) {
+	if msg.delivery != nil {
+		msg.delivery._Done(false)
+	} else if msg.is_durable {
+		_StoreOffline(Envelope{User: msg.receiver, Data: msg.msg, UnixNs: msg.unix_ns})
+	}
+}
+
+// _DeliveredMessage settles a message the client got.
+func _DeliveredMessage(msg Message) {
+	if msg.delivery != nil {
+		msg.delivery._Done(true)
+	}
+}
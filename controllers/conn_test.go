@@ -0,0 +1,67 @@
+package controllers
+
+import (
+	"testing"
+	"time"
+)
+
+// the replay fills half of the queue at most, live messages still fit in
+// the other half.
+func TestConnSendWaitHeadroom(t *testing.T) {
+	conn := _NewTestConn(4)
+	for i := 0; i < 2; i++ {
+		if !conn.SendWait(Message{receiver: "alice"}, time.Second) {
+			t.Fatalf("replayed message %d NOT queued", i)
+		}
+	}
+
+	// the client drains one message while the replay waits.
+	go func() {
+		time.Sleep(5 * CONN_DRAIN_POLL)
+		<-conn.send
+	}()
+	start := time.Now()
+	if !conn.SendWait(Message{receiver: "alice"}, time.Second) {
+		t.Fatal("replayed message NOT queued after the client drained")
+	}
+	if time.Since(start) < 5*CONN_DRAIN_POLL {
+		t.Error("replay did NOT wait for the client")
+	}
+
+	for i := 0; i < 2; i++ {
+		if !conn.Send(Message{receiver: "alice"}) {
+			t.Fatalf("live message %d NOT queued", i)
+		}
+	}
+}
+
+// a message one device got is not stored when another device of the user
+// drops its copy, in any order.
+func TestConnSpillDelivered(t *testing.T) {
+	for _, is_spilled_first := range []bool{true, false} {
+		conn_a := _NewTestConn(1)
+		conn_b := _NewTestConn(1)
+		K_Hub.Register("frank", conn_a)
+		K_Hub.Register("frank", conn_b)
+		if !_SendLocal(K_Hub, Envelope{User: "frank", Data: []byte("hi")}) {
+			t.Fatal("message to online user frank NOT taken")
+		}
+		K_Hub.Unregister("frank", conn_a)
+		K_Hub.Unregister("frank", conn_b)
+
+		msg_a, msg_b := <-conn_a.send, <-conn_b.send
+		if msg_a.delivery == nil || msg_a.delivery != msg_b.delivery {
+			t.Fatal("copies of the message NOT tracked together")
+		}
+		if is_spilled_first {
+			_SpillMessage(msg_b)
+			_DeliveredMessage(msg_a)
+		} else {
+			_DeliveredMessage(msg_a)
+			_SpillMessage(msg_b)
+		}
+		if d := msg_a.delivery; d.pending != 0 || !d.is_delivered {
+			t.Errorf("delivery left with %d pending, delivered: %v", d.pending, d.is_delivered)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package controllers
+
+import (
+	"chat_server/models"
+
+	"github.com/astaxie/beego/logs"
+)
+
+func (this *ChatController) _History() {
+	var req HistoryReq
+	if !this._Decode(&req) {
+		return
+	}
+	if req.Room != "" && !models.IsRoomMember(this.cur_user, req.Room) {
+		logs.Error("User \"%s\" is NOT a member of room \"%s\".", this.cur_user, req.Room)
+		this.ErrReply(PERMISSION_ERR)
+		return
+	}
+
+	reply := HistoryReply{ReplyHeader: this._ReplyHeader(), Msgs: make([]HistoryItem, 0)}
+	for _, m := range models.ListMsgs(this.cur_user, req.Peer, req.Room, req.Before, req.After, req.Limit) {
+		item := HistoryItem{
+			Cursor:    m.Id,
+			MsgId:     m.MsgId,
+			Sender:    m.Sender,
+			Msg:       m.Msg,
+			Timestamp: _UnixMs(m.CreatedAt),
+		}
+		if service := models.ServiceOf(m.Sender); service != "" {
+			item.Sender = ""
+			item.Service = service
+		}
+		if m.Room != "" {
+			item.Room = m.Room
+		} else {
+			item.Receiver = m.Receiver
+		}
+		reply.Msgs = append(reply.Msgs, item)
+	}
+
+	if req.Room != "" {
+		reply.Room = req.Room
+	} else {
+		reply.Peer = req.Peer
+	}
+	this.Reply(reply)
+}
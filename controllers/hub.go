@@ -0,0 +1,110 @@
+package controllers
+
+import (
+	"hash/fnv"
+	"sync"
+)
+
+const (
+	HUB_SHARDS = 32
+)
+
+var (
+	K_Hub = NewHub()
+)
+
+// Hub is the registry of the online users, it's sharded by user name so
+// that logins and deliveries of different users rarely wait on each other.
+type Hub struct {
+	shards [HUB_SHARDS]_HubShard
+}
+
+type _HubShard struct {
+	lock  sync.RWMutex
+	conns map[string]map[*Conn]bool
+}
+
+func NewHub() *Hub {
+	r := new(Hub)
+	for i := range r.shards {
+		r.shards[i].conns = make(map[string]map[*Conn]bool)
+	}
+
+	return r
+}
+
+func (this *Hub) _Shard(user string) *_HubShard {
+	h := fnv.New32a()
+	h.Write([]byte(user))
+
+	return &this.shards[h.Sum32()%HUB_SHARDS]
+}
+
+// Register adds "conn" to the connections of "user", a user may be online
+// on several devices at once. It returns true if it's the first one, i.e.
+// the user just came online.
+func (this *Hub) Register(user string, conn *Conn) bool {
+	s := this._Shard(user)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	conns, ok := s.conns[user]
+	if !ok {
+		conns = make(map[*Conn]bool)
+		s.conns[user] = conns
+	}
+	conns[conn] = true
+
+	return len(conns) == 1
+}
+
+// Unregister removes "conn" from the connections of "user". It returns true
+// if it was the last one, i.e. the user just went offline.
+func (this *Hub) Unregister(user string, conn *Conn) bool {
+	s := this._Shard(user)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	conns, ok := s.conns[user]
+	if !ok || !conns[conn] {
+		return false
+	}
+	delete(conns, conn)
+	if len(conns) != 0 {
+		return false
+	}
+	delete(s.conns, user)
+
+	return true
+}
+
+// Lookup returns the connections of "user", none if the user is offline.
+func (this *Hub) Lookup(user string) []*Conn {
+	s := this._Shard(user)
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	r := make([]*Conn, 0, len(s.conns[user]))
+	for conn := range s.conns[user] {
+		r = append(r, conn)
+	}
+
+	return r
+}
+
+// Snapshot copies the registry, so it can be walked without holding locks.
+func (this *Hub) Snapshot() map[string][]*Conn {
+	r := make(map[string][]*Conn)
+	for i := range this.shards {
+		s := &this.shards[i]
+		s.lock.RLock()
+		for k, v := range s.conns {
+			for conn := range v {
+				r[k] = append(r[k], conn)
+			}
+		}
+		s.lock.RUnlock()
+	}
+
+	return r
+}
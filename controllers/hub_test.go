@@ -0,0 +1,124 @@
+package controllers
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+const (
+	TEST_USERS   = 16
+	TEST_WORKERS = 32
+	TEST_ROUNDS  = 500
+)
+
+// _NewTestConn is a Conn without a websocket, what is sent to it stays in
+// its queue. The queue holds every message of a test, so it's never evicted.
+func _NewTestConn(queue_size int) *Conn {
+	r := new(Conn)
+	r.id = _NewMsgId()
+	r.send = make(chan Message, queue_size)
+	r.closed = make(chan struct{})
+
+	return r
+}
+
+func _TestUser(i int) string {
+	return fmt.Sprintf("user%d", i%TEST_USERS)
+}
+
+// the users coming online and going offline must balance, whatever the
+// interleaving of the devices.
+func TestHubConcurrentRegister(t *testing.T) {
+	hub := NewHub()
+
+	var online int64
+	var wg sync.WaitGroup
+	for w := 0; w < TEST_WORKERS; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < TEST_ROUNDS; i++ {
+				user := _TestUser(w + i)
+				conn := _NewTestConn(1)
+				if hub.Register(user, conn) {
+					atomic.AddInt64(&online, 1)
+				}
+				if len(hub.Lookup(user)) == 0 {
+					t.Errorf("registered user %s NOT found", user)
+				}
+				if i%50 == 0 {
+					hub.Snapshot()
+				}
+				if hub.Unregister(user, conn) {
+					atomic.AddInt64(&online, -1)
+				}
+				// a second unregister is a no-op.
+				if hub.Unregister(user, conn) {
+					t.Errorf("conn of user %s unregistered twice", user)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	if online != 0 {
+		t.Errorf("%d users online after every device left", online)
+	}
+	if n := len(hub.Snapshot()); n != 0 {
+		t.Errorf("%d users left in the hub", n)
+	}
+}
+
+// every device registered for the whole run gets every message of its
+// user, while other devices of the same users come and go.
+func TestHubConcurrentSendLocal(t *testing.T) {
+	queue_size := TEST_WORKERS * TEST_ROUNDS
+	stable := make(map[string]*Conn)
+	for i := 0; i < TEST_USERS; i++ {
+		user := _TestUser(i)
+		stable[user] = _NewTestConn(queue_size)
+		K_Hub.Register(user, stable[user])
+		defer K_Hub.Unregister(user, stable[user])
+	}
+
+	var sent [TEST_USERS]int64
+	var wg sync.WaitGroup
+	for w := 0; w < TEST_WORKERS; w++ {
+		wg.Add(2)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < TEST_ROUNDS; i++ {
+				user := _TestUser(w + i)
+				if !_SendLocal(K_Hub, Envelope{User: user, Data: []byte(user)}) {
+					t.Errorf("message to online user %s NOT taken", user)
+				}
+				atomic.AddInt64(&sent[(w+i)%TEST_USERS], 1)
+			}
+		}(w)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < TEST_ROUNDS; i++ {
+				user := _TestUser(w * i)
+				conn := _NewTestConn(queue_size)
+				K_Hub.Register(user, conn)
+				K_Hub.Snapshot()
+				K_Hub.Unregister(user, conn)
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	for i := 0; i < TEST_USERS; i++ {
+		user := _TestUser(i)
+		if got := int64(len(stable[user].send)); got != sent[i] {
+			t.Errorf("user %s got %d messages, %d sent", user, got, sent[i])
+		}
+		for len(stable[user].send) != 0 {
+			if msg := <-stable[user].send; string(msg.msg) != user || msg.receiver != user {
+				t.Errorf("user %s got a message of %s", user, msg.receiver)
+			}
+		}
+	}
+}
@@ -1,37 +1,76 @@
 package controllers
 
 import (
+	"crypto/rand"
+	"encoding/hex"
+	"strconv"
+	"sync"
+	"time"
+
 	"github.com/astaxie/beego/logs"
-	"github.com/gorilla/websocket"
 )
 
 type Message struct {
 	receiver string
 	msg      []byte
-	conn     *websocket.Conn
+	// a durable message the client doesn't get goes to the offline store,
+	// with the time it was sent.
+	is_durable bool
+	unix_ns    int64
+	// set when copies of the message went to several devices, only the
+	// last copy no device got is stored.
+	delivery *_Delivery
 }
 
-var (
-	K_Msgs = make(chan Message, 2048)
-)
+// _Delivery tracks the copies of a durable message queued to the devices of
+// its receiver on this node, the message goes to the offline store only if
+// none of them gets it.
+type _Delivery struct {
+	lock sync.Mutex
+	// copies not written or dropped yet, plus one held by the sender.
+	pending      int
+	is_delivered bool
+	env          Envelope
+}
+
+func _NewDelivery(env Envelope) *_Delivery {
+	return &_Delivery{pending: 1, env: env}
+}
 
-func init() {
-	go _MsgHandler()
+func (this *_Delivery) _Add() {
+	this.lock.Lock()
+	this.pending++
+	this.lock.Unlock()
 }
 
-func _MsgHandler() {
-	for {
-		msg := <-K_Msgs
-		_SendMessage(&msg)
+// _Done settles a copy, the last one of a message no device got stores it.
+func (this *_Delivery) _Done(is_delivered bool) {
+	this.lock.Lock()
+	if is_delivered {
+		this.is_delivered = true
+	}
+	this.pending--
+	is_lost := this.pending == 0 && !this.is_delivered
+	this.lock.Unlock()
+
+	if is_lost {
+		_StoreOffline(this.env)
 	}
 }
 
-func _SendMessage(msg *Message) {
-	if msg.conn != nil {
-		logs.Debug("Send Message %s To: %s, conn: %p", string(msg.msg), msg.receiver, msg.conn)
-		err := msg.conn.WriteMessage(websocket.TextMessage, msg.msg)
-		if err != nil {
-			logs.Error("Send Message Failed, Msg: %s, To: %s, conn: %p, Error: %s", string(msg.msg), msg.receiver, msg.conn, err.Error())
-		}
+// _NewMsgId generates a server-wide unique message id: the current time
+// followed by 8 random bytes, so ids of the same millisecond never clash.
+func _NewMsgId() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		logs.Error("Generate msg id failed. Error: ", err.Error())
 	}
+
+	return strconv.FormatInt(time.Now().UnixNano(), 36) + hex.EncodeToString(b)
+}
+
+// _UnixMs converts an unix time in nanoseconds to the milliseconds
+// clients get as "timestamp".
+func _UnixMs(unix_ns int64) int64 {
+	return unix_ns / int64(time.Millisecond)
 }
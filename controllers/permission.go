@@ -0,0 +1,125 @@
+package controllers
+
+import (
+	"chat_server/models"
+
+	"strings"
+
+	"github.com/astaxie/beego"
+	"github.com/astaxie/beego/logs"
+)
+
+const (
+	// the role of a connection nobody has logged in on yet.
+	ROLE_GUEST = "guest"
+)
+
+var (
+	// command -> the roles which may run it. Every command must be in it,
+	// the others are unknown.
+	DEFAULT_PERMISSIONS = map[string][]string{
+		"login":  {ROLE_GUEST, models.ROLE_ROOT, models.ROLE_ADMIN, models.ROLE_USER, models.ROLE_BOT},
+		"resume": {ROLE_GUEST, models.ROLE_ROOT, models.ROLE_ADMIN, models.ROLE_USER, models.ROLE_BOT},
+		"logout": {models.ROLE_ROOT, models.ROLE_ADMIN, models.ROLE_USER, models.ROLE_BOT},
+		"passwd": {models.ROLE_ROOT, models.ROLE_ADMIN, models.ROLE_USER, models.ROLE_BOT},
+
+		"adduser":    {models.ROLE_ROOT, models.ROLE_ADMIN},
+		"updateuser": {models.ROLE_ROOT, models.ROLE_ADMIN},
+		"deluser":    {models.ROLE_ROOT, models.ROLE_ADMIN},
+		"listuser":   {models.ROLE_ROOT, models.ROLE_ADMIN},
+		"listlocked": {models.ROLE_ROOT, models.ROLE_ADMIN},
+		"unlock":     {models.ROLE_ROOT, models.ROLE_ADMIN},
+
+		"sendmsg":    {models.ROLE_ROOT, models.ROLE_ADMIN, models.ROLE_USER, models.ROLE_BOT},
+		"createroom": {models.ROLE_ROOT, models.ROLE_ADMIN, models.ROLE_USER},
+		"joinroom":   {models.ROLE_ROOT, models.ROLE_ADMIN, models.ROLE_USER, models.ROLE_BOT},
+		"leaveroom":  {models.ROLE_ROOT, models.ROLE_ADMIN, models.ROLE_USER, models.ROLE_BOT},
+		"listrooms":  {models.ROLE_ROOT, models.ROLE_ADMIN, models.ROLE_USER, models.ROLE_BOT},
+		"history":    {models.ROLE_ROOT, models.ROLE_ADMIN, models.ROLE_USER, models.ROLE_BOT},
+		"ack":        {models.ROLE_ROOT, models.ROLE_ADMIN, models.ROLE_USER, models.ROLE_BOT},
+		"markread":   {models.ROLE_ROOT, models.ROLE_ADMIN, models.ROLE_USER, models.ROLE_BOT},
+
+		"typing_start":        {models.ROLE_ROOT, models.ROLE_ADMIN, models.ROLE_USER},
+		"typing_stop":         {models.ROLE_ROOT, models.ROLE_ADMIN, models.ROLE_USER},
+		"setpresence":         {models.ROLE_ROOT, models.ROLE_ADMIN, models.ROLE_USER},
+		"subscribepresence":   {models.ROLE_ROOT, models.ROLE_ADMIN, models.ROLE_USER},
+		"unsubscribepresence": {models.ROLE_ROOT, models.ROLE_ADMIN, models.ROLE_USER},
+	}
+
+	// command -> role -> true.
+	g_permissions = _LoadPermissions()
+)
+
+// _LoadPermissions starts from DEFAULT_PERMISSIONS, a command in the
+// [permissions] section of the config replaces its roles, e.g.
+// "createroom = root,admin". An empty value revokes it from everybody.
+func _LoadPermissions() map[string]map[string]bool {
+	table := make(map[string][]string)
+	for k, v := range DEFAULT_PERMISSIONS {
+		table[k] = v
+	}
+
+	section, err := beego.AppConfig.GetSection("permissions")
+	if err == nil {
+		for cmd, v := range section {
+			if _, ok := table[cmd]; !ok {
+				logs.Warning("Permission of unknown command \"%s\" ignored.", cmd)
+				continue
+			}
+			var roles []string
+			for _, role := range strings.Split(v, ",") {
+				if role = strings.TrimSpace(role); role != "" {
+					roles = append(roles, role)
+				}
+			}
+			table[cmd] = roles
+		}
+	}
+
+	r := make(map[string]map[string]bool)
+	for cmd, roles := range table {
+		r[cmd] = make(map[string]bool)
+		for _, role := range roles {
+			if role != ROLE_GUEST && !_IsRole(role) {
+				logs.Warning("Unknown role \"%s\" in the permission of command \"%s\".", role, cmd)
+			}
+			r[cmd][role] = true
+		}
+	}
+
+	return r
+}
+
+func _IsRole(role string) bool {
+	for _, v := range models.USER_ROLES {
+		if v == role {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (this *ChatController) _Role() string {
+	if this.cur_user == "" {
+		return ROLE_GUEST
+	}
+
+	return models.RoleOf(this.cur_user_type)
+}
+
+// _Authorize is the one check of whether the current user may run the
+// current command, it runs before the command is dispatched. It returns 0
+// if it may, the error code to reply otherwise.
+func (this *ChatController) _Authorize() int {
+	roles, ok := g_permissions[this.cur_cmd]
+	if !ok {
+		return CMD_TYPE_ERR
+	}
+	if !roles[this._Role()] {
+		logs.Warning("User \"%s\" of role \"%s\" is NOT allowed to run \"%s\".", this.cur_user, this._Role(), this.cur_cmd)
+		return PERMISSION_ERR
+	}
+
+	return 0
+}
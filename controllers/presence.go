@@ -0,0 +1,124 @@
+package controllers
+
+import (
+	"sync"
+
+	"github.com/astaxie/beego/logs"
+)
+
+const (
+	PRESENCE_ONLINE  = "online"
+	PRESENCE_AWAY    = "away"
+	PRESENCE_OFFLINE = "offline"
+)
+
+var (
+	// the statuses are kept by the broker for the whole cluster, the
+	// subscriptions by the node the subscriber subscribed on.
+	g_presence_lock sync.Mutex
+	// user -> the users subscribing to the presence of that user.
+	g_presence_subs = make(map[string]map[string]bool)
+)
+
+// _SetPresence changes the status of "user" and pushes a "presence" event to
+// its online subscribers, on every node, if the status did change.
+func _SetPresence(user, status string) {
+	old := K_Broker.SetPresence(user, status)
+	if old == status {
+		return
+	}
+	logs.Debug("Presence of user \"%s\" changed: %s -> %s", user, old, status)
+
+	e := PresenceEvent{Version: 1, Type: "presence", Event: true, User: user, Status: status}
+	if old == PRESENCE_OFFLINE {
+		e.Msg = _WelcomMsg(user)
+	} else if status == PRESENCE_OFFLINE {
+		e.Msg = _ByeMsg(user)
+	}
+	data, err := _Marshal(e)
+	if err != nil {
+		logs.Error("Presence MarshalJSON failed. Error: ", err.Error())
+		return
+	}
+	K_Broker.PublishPresence(user, data)
+}
+
+// _NotifyPresence pushes the presence event "data" of "user" to the
+// subscribers this node holds, straight to their devices in "hub" since
+// every node gets the event.
+func _NotifyPresence(hub *Hub, user string, data []byte) {
+	g_presence_lock.Lock()
+	subscribers := make([]string, 0, len(g_presence_subs[user]))
+	for k := range g_presence_subs[user] {
+		subscribers = append(subscribers, k)
+	}
+	g_presence_lock.Unlock()
+
+	for _, v := range subscribers {
+		_SendLocal(hub, Envelope{User: v, Data: data, IsEphemeral: true})
+	}
+}
+
+// _DropPresenceSubs removes every subscription "subscriber" holds, they
+// only last as long as the subscriber is online.
+func _DropPresenceSubs(subscriber string) {
+	g_presence_lock.Lock()
+	defer g_presence_lock.Unlock()
+
+	for user, subs := range g_presence_subs {
+		delete(subs, subscriber)
+		if len(subs) == 0 {
+			delete(g_presence_subs, user)
+		}
+	}
+}
+
+func (this *ChatController) _SetPresenceStatus() {
+	var req SetPresenceReq
+	if !this._Decode(&req) {
+		return
+	}
+
+	this.Reply(SetPresenceReply{ReplyHeader: this._ReplyHeader(), Status: req.Status})
+
+	_SetPresence(this.cur_user, req.Status)
+}
+
+func (this *ChatController) _SubscribePresence() {
+	var req UsersReq
+	if !this._Decode(&req) {
+		return
+	}
+
+	g_presence_lock.Lock()
+	for _, v := range req.Users {
+		if _, ok := g_presence_subs[v]; !ok {
+			g_presence_subs[v] = make(map[string]bool)
+		}
+		g_presence_subs[v][this.cur_user] = true
+	}
+	g_presence_lock.Unlock()
+	presence := K_Broker.Presence(req.Users)
+
+	this.Reply(PresenceReply{ReplyHeader: this._ReplyHeader(), Presence: presence})
+}
+
+func (this *ChatController) _UnsubscribePresence() {
+	var req UsersReq
+	if !this._Decode(&req) {
+		return
+	}
+
+	g_presence_lock.Lock()
+	for _, v := range req.Users {
+		if subs, ok := g_presence_subs[v]; ok {
+			delete(subs, this.cur_user)
+			if len(subs) == 0 {
+				delete(g_presence_subs, v)
+			}
+		}
+	}
+	g_presence_lock.Unlock()
+
+	this.Reply(this._ReplyHeader())
+}
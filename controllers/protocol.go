@@ -0,0 +1,435 @@
+package controllers
+
+import (
+	"chat_server/models"
+
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+)
+
+// Requests. Every command decodes into one of these, a field tagged with
+// validate:"required" must be present and not empty.
+
+type CmdReq struct {
+	Id   ReqId  `json:"id"`
+	Type string `json:"type" validate:"required"`
+}
+
+// ReqId is the optional id a client gives a request, a string or a number.
+// It's echoed verbatim in the reply, so a client pipelining requests can
+// tell which reply belongs to which.
+type ReqId []byte
+
+func (this ReqId) MarshalJSON() ([]byte, error) {
+	return []byte(this), nil
+}
+
+func (this *ReqId) UnmarshalJSON(data []byte) error {
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	switch v.(type) {
+	case string, float64:
+		*this = append((*this)[:0], data...)
+		return nil
+	}
+
+	return errors.New("id must be a string or a number")
+}
+
+type LoginReq struct {
+	Name     string `json:"name" validate:"required"`
+	Password string `json:"password" validate:"required"`
+}
+
+type ResumeReq struct {
+	Token string `json:"token" validate:"required"`
+}
+
+type AddUserReq struct {
+	Name     string `json:"name" validate:"required"`
+	Password string `json:"password" validate:"required"`
+}
+
+func (this *AddUserReq) Validate() []FieldError {
+	if strings.HasPrefix(this.Name, models.SERVICE_SENDER_PREFIX) {
+		return []FieldError{{"name", FIELD_INVALID}}
+	}
+
+	return nil
+}
+
+type DeleteUserReq struct {
+	RemoveAll bool     `json:"removeall"`
+	Users     []string `json:"users"`
+	// what becomes of the users created by the deleted ones, see
+	// models.DELETE_MODE_*.
+	Mode       string `json:"mode"`
+	ReassignTo string `json:"reassignto"`
+}
+
+func (this *DeleteUserReq) Validate() []FieldError {
+	var errs []FieldError
+	if !this.RemoveAll && len(this.Users) == 0 {
+		errs = append(errs, FieldError{"users", FIELD_MISSING})
+	}
+	switch this.Mode {
+	case models.DELETE_MODE_ONLY, models.DELETE_MODE_CASCADE:
+	case models.DELETE_MODE_REASSIGN:
+		if this.ReassignTo == "" {
+			errs = append(errs, FieldError{"reassignto", FIELD_MISSING})
+		}
+	default:
+		errs = append(errs, FieldError{"mode", FIELD_INVALID})
+	}
+
+	return errs
+}
+
+// UpdateUserReq changes the fields which are given, at least one of them.
+type UpdateUserReq struct {
+	Name     string `json:"name" validate:"required"`
+	NewName  string `json:"newname"`
+	UserType *int   `json:"usertype"`
+	Password string `json:"password"`
+}
+
+func (this *UpdateUserReq) Validate() []FieldError {
+	if this.NewName == "" && this.UserType == nil && this.Password == "" {
+		return []FieldError{{"newname", FIELD_MISSING}}
+	}
+	if strings.HasPrefix(this.NewName, models.SERVICE_SENDER_PREFIX) {
+		return []FieldError{{"newname", FIELD_INVALID}}
+	}
+	if this.UserType != nil && (*this.UserType == models.USER_ROOT_TYPE || models.RoleOf(*this.UserType) == "") {
+		return []FieldError{{"usertype", FIELD_INVALID}}
+	}
+
+	return nil
+}
+
+type PasswdReq struct {
+	OldPassword string `json:"oldpassword" validate:"required"`
+	Password    string `json:"password" validate:"required"`
+}
+
+type PageReq struct {
+	Start  int `json:"start"`
+	Length int `json:"length"`
+}
+
+func (this *PageReq) Validate() []FieldError {
+	var errs []FieldError
+	if this.Start < 0 {
+		errs = append(errs, FieldError{"start", FIELD_INVALID})
+	}
+	if this.Length < 0 {
+		errs = append(errs, FieldError{"length", FIELD_INVALID})
+	}
+
+	return errs
+}
+
+type ListRoomsReq struct {
+	PageReq
+	Joined bool `json:"joined"`
+}
+
+// TargetReq addresses either a room or a list of receivers.
+type TargetReq struct {
+	Room      string   `json:"room"`
+	Receivers []string `json:"receivers"`
+}
+
+func (this *TargetReq) Validate() []FieldError {
+	if this.Room == "" && len(this.Receivers) == 0 {
+		return []FieldError{{"receivers", FIELD_MISSING}}
+	}
+
+	return nil
+}
+
+type SendMsgReq struct {
+	TargetReq
+	Msg string `json:"msg" validate:"required"`
+}
+
+type RoomReq struct {
+	Room string `json:"room" validate:"required"`
+}
+
+type HistoryReq struct {
+	Peer   string `json:"peer"`
+	Room   string `json:"room"`
+	Before int64  `json:"before"`
+	After  int64  `json:"after"`
+	Limit  int    `json:"limit"`
+}
+
+func (this *HistoryReq) Validate() []FieldError {
+	var errs []FieldError
+	if this.Peer == "" && this.Room == "" {
+		errs = append(errs, FieldError{"peer", FIELD_MISSING})
+	}
+	if this.Before < 0 {
+		errs = append(errs, FieldError{"before", FIELD_INVALID})
+	}
+	if this.After < 0 {
+		errs = append(errs, FieldError{"after", FIELD_INVALID})
+	}
+	if this.Limit < 0 {
+		errs = append(errs, FieldError{"limit", FIELD_INVALID})
+	}
+
+	return errs
+}
+
+type ReceiptReq struct {
+	MsgId string `json:"msgid" validate:"required"`
+}
+
+type SetPresenceReq struct {
+	Status string `json:"status" validate:"required"`
+}
+
+func (this *SetPresenceReq) Validate() []FieldError {
+	if this.Status != "" && this.Status != PRESENCE_ONLINE && this.Status != PRESENCE_AWAY {
+		return []FieldError{{"status", FIELD_INVALID}}
+	}
+
+	return nil
+}
+
+type UsersReq struct {
+	Users []string `json:"users" validate:"required"`
+}
+
+// Replies. ReplyHeader alone is the reply of the commands which return
+// nothing but their success. Every reply, errors included, carries the id
+// of its request if the client gave one.
+
+type ReplyHeader struct {
+	Version int    `json:"version"`
+	Code    int    `json:"code"`
+	Type    string `json:"type"`
+	Id      ReqId  `json:"id,omitempty"`
+}
+
+type ErrorReply struct {
+	Type   string       `json:"type"`
+	Id     ReqId        `json:"id,omitempty"`
+	Code   int          `json:"code"`
+	Reason string       `json:"reason"`
+	Errors []FieldError `json:"errors,omitempty"`
+	// ms to wait before retrying, e.g. a throttled login.
+	RetryAfter int64 `json:"retryafter,omitempty"`
+}
+
+type LoginReply struct {
+	ReplyHeader
+	Name     string `json:"name,omitempty"`
+	UserType int    `json:"usertype"`
+	Role     string `json:"role"`
+	Token    string `json:"token,omitempty"`
+	Expires  int64  `json:"expires,omitempty"`
+}
+
+type UsersReply struct {
+	ReplyHeader
+	Users []string `json:"users"`
+}
+
+type DeleteUserReply struct {
+	ReplyHeader
+	Deleted    int `json:"deleted"`
+	Reassigned int `json:"reassigned"`
+	// the accounts deleted or reassigned.
+	Affected int `json:"affected"`
+}
+
+type LockedAccount struct {
+	Name     string `json:"name"`
+	Failures int    `json:"failures"`
+	Until    int64  `json:"until"`
+}
+
+type LockedReply struct {
+	ReplyHeader
+	Locked []LockedAccount `json:"locked"`
+}
+
+type SendMsgReply struct {
+	ReplyHeader
+	MsgId     string `json:"msgid"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+type RoomReply struct {
+	ReplyHeader
+	Room string `json:"room"`
+}
+
+type RoomsReply struct {
+	ReplyHeader
+	Rooms []string `json:"rooms"`
+}
+
+type HistoryItem struct {
+	Cursor    int64  `json:"cursor"`
+	MsgId     string `json:"msgid"`
+	Sender    string `json:"sender"`
+	Service   string `json:"service,omitempty"`
+	Receiver  string `json:"receiver,omitempty"`
+	Room      string `json:"room,omitempty"`
+	Msg       string `json:"msg"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+type HistoryReply struct {
+	ReplyHeader
+	Peer string        `json:"peer,omitempty"`
+	Room string        `json:"room,omitempty"`
+	Msgs []HistoryItem `json:"msgs"`
+}
+
+type ReceiptReply struct {
+	ReplyHeader
+	MsgId string `json:"msgid"`
+}
+
+type SetPresenceReply struct {
+	ReplyHeader
+	Status string `json:"status"`
+}
+
+type PresenceReply struct {
+	ReplyHeader
+	Presence map[string]string `json:"presence"`
+}
+
+// Events, pushed by the server without a request of the receiver. They
+// never carry an id and always carry "event": true, so a client can't take
+// one for a reply.
+
+// RecvMsgEvent is a message of a user, or of a backend service when
+// Service is set, Sender is empty then.
+type RecvMsgEvent struct {
+	Version   int      `json:"version"`
+	Type      string   `json:"type"`
+	Event     bool     `json:"event"`
+	Sender    string   `json:"sender"`
+	Service   string   `json:"service,omitempty"`
+	Msg       string   `json:"msg"`
+	MsgId     string   `json:"msgid"`
+	Timestamp int64    `json:"timestamp"`
+	Room      string   `json:"room,omitempty"`
+	Receivers []string `json:"receivers,omitempty"`
+}
+
+type ReceiptEvent struct {
+	Version   int    `json:"version"`
+	Type      string `json:"type"`
+	Event     bool   `json:"event"`
+	MsgId     string `json:"msgid"`
+	By        string `json:"by"`
+	Room      string `json:"room,omitempty"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+type TypingEvent struct {
+	Version int    `json:"version"`
+	Type    string `json:"type"`
+	Event   bool   `json:"event"`
+	Sender  string `json:"sender"`
+	Room    string `json:"room,omitempty"`
+}
+
+type PresenceEvent struct {
+	Version int    `json:"version"`
+	Type    string `json:"type"`
+	Event   bool   `json:"event"`
+	User    string `json:"user"`
+	Status  string `json:"status"`
+	Msg     string `json:"msg,omitempty"`
+}
+
+// Validation.
+
+const (
+	FIELD_MISSING = "missing"
+	FIELD_INVALID = "invalid"
+)
+
+type FieldError struct {
+	Field  string `json:"field"`
+	Reason string `json:"reason"`
+}
+
+// _Validator is implemented by the requests with rules over several
+// fields, it runs after every field decoded fine.
+type _Validator interface {
+	Validate() []FieldError
+}
+
+// _DecodeFields decodes the fields of a request into the struct "v" points
+// to, one by one, so that every missing or mistyped field is reported
+// instead of only the first one.
+func _DecodeFields(fields map[string]json.RawMessage, v interface{}) []FieldError {
+	errs := _DecodeStruct(fields, reflect.ValueOf(v).Elem())
+	if len(errs) != 0 {
+		return errs
+	}
+
+	if validator, ok := v.(_Validator); ok {
+		return validator.Validate()
+	}
+
+	return nil
+}
+
+func _DecodeStruct(fields map[string]json.RawMessage, rv reflect.Value) []FieldError {
+	var errs []FieldError
+
+	rt := rv.Type()
+	for i := 0; i < rt.NumField(); i++ {
+		f := rt.Field(i)
+		fv := rv.Field(i)
+		// the fields of embedded structs are promoted, so are their rules.
+		if f.Anonymous && f.Type.Kind() == reflect.Struct {
+			errs = append(errs, _DecodeStruct(fields, fv)...)
+			continue
+		}
+
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		is_required := f.Tag.Get("validate") == "required"
+
+		raw, ok := fields[name]
+		if !ok || string(raw) == "null" {
+			if is_required {
+				errs = append(errs, FieldError{name, FIELD_MISSING})
+			}
+			continue
+		}
+		if err := json.Unmarshal(raw, fv.Addr().Interface()); err != nil {
+			errs = append(errs, FieldError{name, FIELD_INVALID})
+			continue
+		}
+		if is_required && _IsEmpty(fv) {
+			errs = append(errs, FieldError{name, FIELD_MISSING})
+		}
+	}
+
+	return errs
+}
+
+func _IsEmpty(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.String, reflect.Slice, reflect.Map, reflect.Array:
+		return v.Len() == 0
+	}
+
+	return v.IsZero()
+}
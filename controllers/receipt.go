@@ -0,0 +1,59 @@
+package controllers
+
+import (
+	"chat_server/models"
+
+	"time"
+
+	"github.com/astaxie/beego/logs"
+)
+
+var (
+	RECEIPT_EVENTS = map[int]string{
+		models.RECEIPT_DELIVERED: "delivered",
+		models.RECEIPT_READ:      "read",
+	}
+)
+
+func (this *ChatController) _Ack() {
+	this._Receipt(models.RECEIPT_DELIVERED)
+}
+
+func (this *ChatController) _MarkRead() {
+	this._Receipt(models.RECEIPT_READ)
+}
+
+// _Receipt records a receipt of the current user and pushes it to the
+// sender of the message, it is kept offline until the sender logs in. A
+// backend service never logs in, it gets none.
+func (this *ChatController) _Receipt(status int) {
+	var req ReceiptReq
+	if !this._Decode(&req) {
+		return
+	}
+
+	m, ok := models.GetMsg(req.MsgId, this.cur_user)
+	if !ok {
+		logs.Error("Msg \"%s\" is NOT addressed to user \"%s\".", req.MsgId, this.cur_user)
+		this.ErrReply(RECEIPT_ERR)
+		return
+	}
+
+	this.Reply(ReceiptReply{ReplyHeader: this._ReplyHeader(), MsgId: req.MsgId})
+
+	unix_ns := time.Now().UnixNano()
+	if !models.SetReceipt(req.MsgId, this.cur_user, status, unix_ns) || models.ServiceOf(m.Sender) != "" {
+		return
+	}
+
+	e := ReceiptEvent{
+		Version:   1,
+		Type:      RECEIPT_EVENTS[status],
+		Event:     true,
+		MsgId:     req.MsgId,
+		By:        this.cur_user,
+		Room:      m.Room,
+		Timestamp: _UnixMs(unix_ns),
+	}
+	this.SendMsg(e, unix_ns, []string{m.Sender})
+}
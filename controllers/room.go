@@ -0,0 +1,76 @@
+package controllers
+
+import (
+	"chat_server/models"
+)
+
+func (this *ChatController) _CreateRoom() {
+	var req RoomReq
+	if !this._Decode(&req) {
+		return
+	}
+
+	if models.CreateRoom(this.cur_user_id, this.cur_user, req.Room) {
+		this.Reply(RoomReply{ReplyHeader: this._ReplyHeader(), Room: req.Room})
+	} else {
+		this.ErrReply(CREATE_ROOM_ERR)
+	}
+}
+
+func (this *ChatController) _JoinRoom() {
+	var req RoomReq
+	if !this._Decode(&req) {
+		return
+	}
+
+	if models.JoinRoom(this.cur_user, req.Room) {
+		this.Reply(RoomReply{ReplyHeader: this._ReplyHeader(), Room: req.Room})
+	} else {
+		this.ErrReply(JOIN_ROOM_ERR)
+	}
+}
+
+func (this *ChatController) _LeaveRoom() {
+	var req RoomReq
+	if !this._Decode(&req) {
+		return
+	}
+
+	if models.LeaveRoom(this.cur_user, req.Room) {
+		this.Reply(RoomReply{ReplyHeader: this._ReplyHeader(), Room: req.Room})
+	} else {
+		this.ErrReply(LEAVE_ROOM_ERR)
+	}
+}
+
+func (this *ChatController) _ListRooms() {
+	var req ListRoomsReq
+	if !this._Decode(&req) {
+		return
+	}
+
+	user := ""
+	if req.Joined {
+		user = this.cur_user
+	}
+
+	rooms := models.ListRooms(user, req.Start, req.Length)
+	this.Reply(RoomsReply{ReplyHeader: this._ReplyHeader(), Rooms: rooms})
+}
+
+// _RoomReceivers returns the members of "room" except the current user,
+// or false if the current user is not allowed to talk in it.
+func (this *ChatController) _RoomReceivers(room string) ([]string, bool) {
+	if !models.IsRoomMember(this.cur_user, room) {
+		return nil, false
+	}
+
+	receivers := make([]string, 0)
+	for _, v := range models.ListRoomMembers(room) {
+		if v != this.cur_user {
+			receivers = append(receivers, v)
+		}
+	}
+
+	return receivers, true
+}
@@ -0,0 +1,286 @@
+package controllers
+
+import (
+	"chat_server/models"
+
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/astaxie/beego/logs"
+)
+
+var (
+	// failed logins of an account before it's locked, the logins still
+	// being checked count too, so parallel tries can't go past it.
+	LOGIN_MAX_ACCOUNT_FAILURES = models.ConfIntMin("login_max_account_failures", 5, 1)
+	// failed logins from a remote IP, whatever the accounts, before it's
+	// locked out. There is no backoff per IP, the users behind the same
+	// NAT don't wait on each other.
+	LOGIN_MAX_IP_FAILURES = models.ConfIntMin("login_max_ip_failures", 20, 1)
+	// the wait after the first failure of an account, it doubles with every
+	// further one.
+	LOGIN_BACKOFF_BASE = time.Duration(models.ConfIntMin("login_backoff_base", 1, 1)) * time.Second
+	// how long a lockout lasts, failures older than it are forgotten.
+	LOGIN_LOCKOUT = time.Duration(models.ConfIntMin("login_lockout", 900, 1)) * time.Second
+	// the reverse proxies in front of the server, only the requests coming
+	// from them are believed about the address of the client.
+	TRUSTED_PROXIES = _ParseTrustedProxies(models.ConfStrings("trusted_proxies"))
+
+	// the failures are kept per node, in memory.
+	g_login_lock     sync.Mutex
+	g_login_accounts = make(map[string]*_LoginFailures)
+	g_login_ips      = make(map[string]*_LoginFailures)
+)
+
+type _LoginFailures struct {
+	count        int
+	last         time.Time
+	locked_until time.Time
+	// the logins being checked, only kept for accounts.
+	pending int
+}
+
+func init() {
+	go _ReapLoginFailures()
+}
+
+// _CheckLogin tells whether a login of "name" from "ip" may be tried now.
+// It returns 0 if it may, otherwise the error code to reply and how long to
+// wait before retrying. The try it lets through is pending until
+// _LoginSucceeded or _LoginFailed settles it.
+func _CheckLogin(name, ip string) (int, time.Duration) {
+	g_login_lock.Lock()
+	defer g_login_lock.Unlock()
+
+	now := time.Now()
+	if f, ok := g_login_ips[ip]; ok && now.Before(f.locked_until) {
+		return IP_LOCKED_ERR, f.locked_until.Sub(now)
+	}
+
+	f := _LoginEntry(g_login_accounts, name, now)
+	if now.Before(f.locked_until) {
+		return USER_LOCKED_ERR, f.locked_until.Sub(now)
+	}
+	if f.count != 0 {
+		backoff := LOGIN_BACKOFF_BASE << uint(f.count-1)
+		if backoff <= 0 || backoff > LOGIN_LOCKOUT {
+			backoff = LOGIN_LOCKOUT
+		}
+		if wait := f.last.Add(backoff).Sub(now); wait > 0 {
+			return LOGIN_WAIT_ERR, wait
+		}
+	}
+	// if every pending try failed the account would be locked.
+	if f.count+f.pending >= LOGIN_MAX_ACCOUNT_FAILURES {
+		return LOGIN_WAIT_ERR, LOGIN_BACKOFF_BASE
+	}
+
+	f.pending++
+	return 0, 0
+}
+
+// _LoginEntry returns the failures of "key", failures which are stale are
+// forgotten.
+func _LoginEntry(failures map[string]*_LoginFailures, key string, now time.Time) *_LoginFailures {
+	f, ok := failures[key]
+	if !ok {
+		f = new(_LoginFailures)
+		failures[key] = f
+	}
+	if _IsLoginFailureStale(f, now) {
+		f.count = 0
+	}
+
+	return f
+}
+
+// _LoginFailed settles the pending login of "name" from "ip" as failed, the
+// account or the IP is locked when it has failed too often.
+func _LoginFailed(name, ip string) {
+	g_login_lock.Lock()
+	defer g_login_lock.Unlock()
+
+	now := time.Now()
+	f := _LoginEntry(g_login_accounts, name, now)
+	if f.pending > 0 {
+		f.pending--
+	}
+	if _AddLoginFailure(f, LOGIN_MAX_ACCOUNT_FAILURES, now) {
+		logs.Warning("Account \"%s\" locked after %d failed logins, last from %s.", name, LOGIN_MAX_ACCOUNT_FAILURES, ip)
+	}
+	if _AddLoginFailure(_LoginEntry(g_login_ips, ip, now), LOGIN_MAX_IP_FAILURES, now) {
+		logs.Warning("IP %s locked out after %d failed logins.", ip, LOGIN_MAX_IP_FAILURES)
+	}
+}
+
+// _AddLoginFailure counts a failure in "f", it returns true if that locks
+// it.
+func _AddLoginFailure(f *_LoginFailures, max int, now time.Time) bool {
+	f.count++
+	f.last = now
+	if f.count < max || now.Before(f.locked_until) {
+		return false
+	}
+	f.locked_until = now.Add(LOGIN_LOCKOUT)
+
+	return true
+}
+
+// _LoginSucceeded settles the pending login of "name" and forgets its
+// failures. The failures of the IP are kept, a valid account must not
+// clear the way for guessing the others.
+func _LoginSucceeded(name string) {
+	g_login_lock.Lock()
+	defer g_login_lock.Unlock()
+
+	f, ok := g_login_accounts[name]
+	if !ok {
+		return
+	}
+	if f.pending--; f.pending <= 0 {
+		delete(g_login_accounts, name)
+		return
+	}
+	// the other pending tries go on from a clean slate.
+	f.count = 0
+	f.locked_until = time.Time{}
+}
+
+func _IsLoginFailureStale(f *_LoginFailures, now time.Time) bool {
+	return now.After(f.locked_until) && now.Sub(f.last) > LOGIN_LOCKOUT
+}
+
+func _ReapLoginFailures() {
+	for range time.Tick(LOGIN_LOCKOUT) {
+		g_login_lock.Lock()
+		now := time.Now()
+		for _, failures := range []map[string]*_LoginFailures{g_login_accounts, g_login_ips} {
+			for k, f := range failures {
+				if f.pending == 0 && _IsLoginFailureStale(f, now) {
+					delete(failures, k)
+				}
+			}
+		}
+		g_login_lock.Unlock()
+	}
+}
+
+func _ParseTrustedProxies(values []string) []*net.IPNet {
+	r := make([]*net.IPNet, 0)
+	for _, v := range values {
+		if v = strings.TrimSpace(v); v == "" {
+			continue
+		}
+		if !strings.Contains(v, "/") {
+			if strings.Contains(v, ":") {
+				v += "/128"
+			} else {
+				v += "/32"
+			}
+		}
+		_, n, err := net.ParseCIDR(v)
+		if err != nil {
+			logs.Warning("Malformed trusted proxy ignored: %q", v)
+			continue
+		}
+		r = append(r, n)
+	}
+
+	return r
+}
+
+func _IsTrustedProxy(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, v := range TRUSTED_PROXIES {
+		if v.Contains(parsed) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// _RemoteIP returns the address of the client of "r". The client writes
+// whatever it likes into X-Forwarded-For, only what the trusted proxies
+// appended to it is believed: the client is the last address before them.
+func _RemoteIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0 && _IsTrustedProxy(ip); i-- {
+		hop := strings.TrimSpace(hops[i])
+		if net.ParseIP(hop) == nil {
+			break
+		}
+		ip = hop
+	}
+
+	return ip
+}
+
+// _ListLocked lists the locked accounts the current user owns, every one
+// for root.
+func (this *ChatController) _ListLocked() {
+	g_login_lock.Lock()
+	now := time.Now()
+	locked := make([]LockedAccount, 0)
+	for k, f := range g_login_accounts {
+		if now.Before(f.locked_until) {
+			locked = append(locked, LockedAccount{Name: k, Failures: f.count, Until: _UnixMs(f.locked_until.UnixNano())})
+		}
+	}
+	g_login_lock.Unlock()
+
+	if this.cur_user_type != models.USER_ROOT_TYPE {
+		names := make([]string, 0, len(locked))
+		for _, v := range locked {
+			names = append(names, v.Name)
+		}
+		owned := make(map[string]bool)
+		for _, v := range models.FilterOwnedUsers(this.cur_user_id, this.cur_user_type, names) {
+			owned[v] = true
+		}
+		r := make([]LockedAccount, 0, len(owned))
+		for _, v := range locked {
+			if owned[v.Name] {
+				r = append(r, v)
+			}
+		}
+		locked = r
+	}
+
+	sort.Slice(locked, func(i, j int) bool { return locked[i].Name < locked[j].Name })
+	this.Reply(LockedReply{ReplyHeader: this._ReplyHeader(), Locked: locked})
+}
+
+// _Unlock unlocks accounts the current user owns, every one for root.
+func (this *ChatController) _Unlock() {
+	var req UsersReq
+	if !this._Decode(&req) {
+		return
+	}
+	if owned := models.FilterOwnedUsers(this.cur_user_id, this.cur_user_type, req.Users); len(owned) != len(req.Users) {
+		logs.Warning("User \"%s\" may NOT unlock every one of %v.", this.cur_user, req.Users)
+		this.ErrReply(PERMISSION_ERR)
+		return
+	}
+
+	g_login_lock.Lock()
+	for _, v := range req.Users {
+		delete(g_login_accounts, v)
+	}
+	g_login_lock.Unlock()
+
+	logs.Info("User \"%s\" unlocked accounts: %v", this.cur_user, req.Users)
+	this.Reply(UsersReply{ReplyHeader: this._ReplyHeader(), Users: req.Users})
+}
@@ -0,0 +1,54 @@
+package controllers
+
+import (
+	"fmt"
+	"testing"
+)
+
+// a login being checked only holds back tries of the same account, and
+// only once they could lock it.
+func TestLoginPending(t *testing.T) {
+	if code, _ := _CheckLogin("grace", "192.0.2.1"); code != 0 {
+		t.Fatalf("first login of grace refused, code: %d", code)
+	}
+	if code, _ := _CheckLogin("heidi", "192.0.2.1"); code != 0 {
+		t.Errorf("login of heidi from the same IP refused, code: %d", code)
+	}
+	for i := 1; i < LOGIN_MAX_ACCOUNT_FAILURES; i++ {
+		if code, _ := _CheckLogin("grace", "192.0.2.2"); code != 0 {
+			t.Errorf("concurrent login %d of grace refused, code: %d", i, code)
+		}
+	}
+	if code, _ := _CheckLogin("grace", "192.0.2.3"); code != LOGIN_WAIT_ERR {
+		t.Errorf("login of grace past the pending limit got code %d, want %d", code, LOGIN_WAIT_ERR)
+	}
+
+	_LoginSucceeded("heidi")
+	for i := 0; i < LOGIN_MAX_ACCOUNT_FAILURES; i++ {
+		_LoginSucceeded("grace")
+	}
+	if code, _ := _CheckLogin("grace", "192.0.2.3"); code != 0 {
+		t.Errorf("login of grace after the others settled refused, code: %d", code)
+	}
+	_LoginSucceeded("grace")
+}
+
+// the failures of an IP lock it out at its threshold, with no backoff
+// before.
+func TestLoginIPLockout(t *testing.T) {
+	ip := "198.51.100.1"
+	for i := 0; i < LOGIN_MAX_IP_FAILURES; i++ {
+		name := fmt.Sprintf("ipuser%d", i)
+		if code, _ := _CheckLogin(name, ip); code != 0 {
+			t.Fatalf("login %d from %s refused, code: %d", i, ip, code)
+		}
+		_LoginFailed(name, ip)
+	}
+	if code, _ := _CheckLogin("ivan", ip); code != IP_LOCKED_ERR {
+		t.Errorf("login from a locked IP got code %d, want %d", code, IP_LOCKED_ERR)
+	}
+
+	g_login_lock.Lock()
+	delete(g_login_ips, ip)
+	g_login_lock.Unlock()
+}
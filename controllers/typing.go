@@ -0,0 +1,112 @@
+package controllers
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/astaxie/beego/logs"
+)
+
+const (
+	// a "typing_stop" is sent on behalf of a client which doesn't send one
+	// within this duration after its last "typing_start".
+	TYPING_TIMEOUT = 5 * time.Second
+)
+
+var (
+	g_typing_lock   sync.Mutex
+	g_typing_timers = make(map[string]*time.Timer)
+)
+
+func (this *ChatController) _TypingStart() {
+	this._Typing(true)
+}
+
+func (this *ChatController) _TypingStop() {
+	this._Typing(false)
+}
+
+// _Typing relays typing events to the online receivers only, they are
+// ephemeral and never go to the offline store.
+func (this *ChatController) _Typing(is_typing bool) {
+	var req TargetReq
+	if !this._Decode(&req) {
+		return
+	}
+
+	receivers, ok := this._Receivers(req)
+	if !ok {
+		return
+	}
+	room := req.Room
+
+	this.Reply(this._ReplyHeader())
+
+	start_data, err := _Marshal(this._ConstructTypingEvent("typing_start", room))
+	if err != nil {
+		logs.Error("Typing MarshalJSON failed. Error: ", err.Error())
+		return
+	}
+	stop_data, err := _Marshal(this._ConstructTypingEvent("typing_stop", room))
+	if err != nil {
+		logs.Error("Typing MarshalJSON failed. Error: ", err.Error())
+		return
+	}
+
+	key := this.cur_user + "\n" + room
+	if room == "" {
+		sorted := append([]string(nil), receivers...)
+		sort.Strings(sorted)
+		key += "\n" + strings.Join(sorted, "\n")
+	}
+
+	if is_typing {
+		_ArmTyping(key, stop_data, receivers)
+		_SendOnline(start_data, receivers)
+	} else {
+		_DisarmTyping(key)
+		_SendOnline(stop_data, receivers)
+	}
+}
+
+func (this *ChatController) _ConstructTypingEvent(event, room string) TypingEvent {
+	return TypingEvent{Version: 1, Type: event, Event: true, Sender: this.cur_user, Room: room}
+}
+
+// _ArmTyping (re)starts the expiry timer of "key", when it fires the
+// receivers get "stop_data" as if the sender had stopped typing.
+func _ArmTyping(key string, stop_data []byte, receivers []string) {
+	g_typing_lock.Lock()
+	defer g_typing_lock.Unlock()
+
+	if t, ok := g_typing_timers[key]; ok {
+		t.Stop()
+	}
+
+	var t *time.Timer
+	t = time.AfterFunc(TYPING_TIMEOUT, func() {
+		g_typing_lock.Lock()
+		if g_typing_timers[key] != t {
+			g_typing_lock.Unlock()
+			return
+		}
+		delete(g_typing_timers, key)
+		g_typing_lock.Unlock()
+
+		logs.Debug("Typing expired, key: %q", key)
+		_SendOnline(stop_data, receivers)
+	})
+	g_typing_timers[key] = t
+}
+
+func _DisarmTyping(key string) {
+	g_typing_lock.Lock()
+	defer g_typing_lock.Unlock()
+
+	if t, ok := g_typing_timers[key]; ok {
+		t.Stop()
+		delete(g_typing_timers, key)
+	}
+}
@@ -1,9 +1,13 @@
 package main
 
 import (
+	"chat_server/models"
 	_ "chat_server/routers"
 
+	"os"
+
 	"github.com/astaxie/beego"
+	"github.com/astaxie/beego/logs"
 )
 
 func main() {
@@ -12,5 +16,9 @@ func main() {
 		beego.BConfig.WebConfig.StaticDir["/swagger"] = "swagger"
 	}
 
+	if err := models.Init(); err != nil {
+		logs.Critical("Open the database failed, check the db_* settings. Error: ", err.Error())
+		os.Exit(1)
+	}
 	beego.Run()
 }
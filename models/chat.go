@@ -3,6 +3,9 @@ package models
 import (
 	"chat_server/models/db"
 
+	"fmt"
+	"time"
+
 	"github.com/astaxie/beego/logs"
 )
 
@@ -10,31 +13,71 @@ const (
 	USER_ROOT_TYPE   = 0
 	USER_ADMIN_TYPE  = 1
 	USER_NORMAL_TYPE = 1024
+	USER_BOT_TYPE    = 2048
 )
 
+// the roles are the names of the user types, the permissions are granted to
+// them.
+const (
+	ROLE_ROOT  = "root"
+	ROLE_ADMIN = "admin"
+	ROLE_USER  = "user"
+	ROLE_BOT   = "bot"
+)
+
+var (
+	USER_ROLES = map[int]string{
+		USER_ROOT_TYPE:   ROLE_ROOT,
+		USER_ADMIN_TYPE:  ROLE_ADMIN,
+		USER_NORMAL_TYPE: ROLE_USER,
+		USER_BOT_TYPE:    ROLE_BOT,
+	}
+)
+
+// RoleOf returns the role of "user_type", an empty string if it has none.
+func RoleOf(user_type int) string {
+	return USER_ROLES[user_type]
+}
+
 var mysql db.DB
 
-func Init() {
-	var err error
-	mysql, err = db.New("mysql",
-		"sdkbox",
-		"1234",
-		"chat",
-		"localhost",
-		"3306",
+// Init opens the database, it must be called once at startup before any
+// other function of the package. It fails if the settings are missing or
+// the database can't be reached with them.
+func Init() error {
+	driver := ConfString("db_driver", "mysql")
+	default_port := "3306"
+	if driver == "postgres" {
+		default_port = "5432"
+	}
+
+	d, err := db.New(driver,
+		ConfString("db_user", "sdkbox"),
+		ConfString("db_password", ""),
+		ConfString("db_name", "chat"),
+		ConfString("db_host", "localhost"),
+		ConfString("db_port", default_port),
 	)
 	if err != nil {
-		logs.Error("create mysql object failed: ", err.Error())
+		return err
+	}
+	if err := d.(*db.DBase).Ping(); err != nil {
+		return err
 	}
+
+	d.(*db.DBase).SetPool(
+		ConfIntMin("db_max_open_conns", 0, 0),
+		ConfIntMin("db_max_idle_conns", 2, 0),
+		time.Duration(ConfIntMin("db_conn_max_lifetime", 0, 0))*time.Second,
+	)
+	mysql = d
+
+	return nil
 }
 
 func UserLogin(name, password string) (int64, int) {
 	logs.Debug("login name: ", name)
-	logs.Debug("password: ", password)
 
-	if _, ok := mysql.(*db.DBase); !ok {
-		Init()
-	}
 	stat, err := db.NewDBStat("chat_users")
 	if err != nil {
 		logs.Error("NewDBStat failed. Error: ", err.Error())
@@ -67,10 +110,14 @@ func UserLogin(name, password string) (int64, int) {
 				return 0, 0
 			}
 		}
-		if password != passwd {
+		is_match, is_legacy := CheckPassword(passwd, password)
+		if !is_match {
 			logs.Warning("User password is Wrong.")
 			return 0, 0
 		}
+		if is_legacy {
+			_UpgradePassword(id, password)
+		}
 		return id, user_type
 	}
 
@@ -78,14 +125,33 @@ func UserLogin(name, password string) (int64, int) {
 	return 0, 0
 }
 
+// _UpgradePassword replaces the plaintext password of user "id" with its
+// hash, a failure is only logged as the row is still usable.
+func _UpgradePassword(id int64, password string) {
+	logs.Info("upgrade plaintext password of user id: %d", id)
+
+	hash, err := HashPassword(password)
+	if err != nil {
+		logs.Error("Hash password failed. Error: ", err.Error())
+		return
+	}
+
+	stat, err := db.NewDBStat("chat_users")
+	if err != nil {
+		logs.Error("NewDBStat failed. Error: ", err.Error())
+		return
+	}
+
+	err = mysql.Update(map[string]interface{}{"passwd": hash}, stat.Where("id", id).From())
+	if err != nil {
+		logs.Error("db Update operation failed. Error: ", err.Error())
+	}
+}
+
 func AddUser(cur_id int64, cur_type int, name, password string) int64 {
 	logs.Debug("add user cur_id: %d, cur_type: %d", cur_id, cur_type)
 	logs.Debug("add user name: ", name)
-	logs.Debug("add user passwd: ", password)
 
-	if _, ok := mysql.(*db.DBase); !ok {
-		Init()
-	}
 	stat, err := db.NewDBStat("chat_users")
 	if err != nil {
 		logs.Error("NewDBStat failed. Error: ", err.Error())
@@ -99,9 +165,14 @@ func AddUser(cur_id int64, cur_type int, name, password string) int64 {
 	}
 
 	if !is_exist {
+		hash, err := HashPassword(password)
+		if err != nil {
+			logs.Error("Hash password failed. Error: ", err.Error())
+			return 0
+		}
 		data := map[string]interface{}{
 			"user_name":  name,
-			"passwd":     password,
+			"passwd":     hash,
 			"user_type":  USER_NORMAL_TYPE,
 			"created_by": cur_id,
 		}
@@ -120,46 +191,264 @@ func AddUser(cur_id int64, cur_type int, name, password string) int64 {
 	return 0
 }
 
-func DeleteUser(cur_id int64, cur_type int, users []string, is_remove_all bool) bool {
+// the ways DeleteUser treats the users created by the deleted ones.
+const (
+	// leave them as they are.
+	DELETE_MODE_ONLY = ""
+	// delete them too, and the users they created, and so on.
+	DELETE_MODE_CASCADE = "cascade"
+	// hand them over to another admin.
+	DELETE_MODE_REASSIGN = "reassign"
+)
+
+// DeleteUser returns the names of the deleted users and the number of the
+// users reassigned to "reassign_to", which is only used by
+// DELETE_MODE_REASSIGN. Root may delete every user but itself, an admin
+// only the users it created, nothing is deleted if "users" names another.
+func DeleteUser(cur_id int64, cur_type int, users []string, is_remove_all bool, mode, reassign_to string) ([]string, int, bool) {
 	logs.Debug("delete user cur_id: %d, cur_type: %d", cur_id, cur_type)
-	logs.Debug("delete user, is_remove_all: ", is_remove_all)
+	logs.Debug("delete user, is_remove_all: %v, mode: %q, reassign_to: %q", is_remove_all, mode, reassign_to)
 	logs.Debug("delete users: ", users)
 
-	if _, ok := mysql.(*db.DBase); !ok {
-		Init()
-	}
 	stat, err := db.NewDBStat("chat_users")
 	if err != nil {
 		logs.Error("NewDBStat failed. Error: ", err.Error())
-		return false
+		return nil, 0, false
 	}
 
-	if is_remove_all {
+	deleted := make([]string, 0)
+	reassigned := 0
+	// the users, their sessions and the reassignments go all together or
+	// not at all.
+	err = mysql.WithTx(func(tx db.DB) error {
+		var targets map[int64]string
 		var err error
-		if cur_type == USER_ROOT_TYPE {
-			err = mysql.Delete(stat.Where("user_name !=", "root").From())
+		if is_remove_all {
+			if cur_type == USER_ROOT_TYPE {
+				targets, err = _QueryUsers(tx, stat.Where("user_type !=", USER_ROOT_TYPE).From())
+			} else {
+				targets, err = _QueryUsers(tx, stat.Where("created_by", cur_id).Where("id !=", cur_id).From())
+			}
 		} else {
-			err = mysql.Delete(stat.Where("created_by", cur_id).From())
+			targets, err = _QueryDeleteTargets(tx, stat, cur_id, cur_type, users)
 		}
 		if err != nil {
-			logs.Error("db Delete operation failed. Error: ", err.Error())
-			return false
+			return err
 		}
-		return true
+
+		switch mode {
+		case DELETE_MODE_CASCADE:
+			if err := _ExpandSubtree(tx, stat, cur_id, targets); err != nil {
+				return err
+			}
+
+		case DELETE_MODE_REASSIGN:
+			n, err := _ReassignUsers(tx, stat, targets, reassign_to)
+			if err != nil {
+				return err
+			}
+			reassigned = n
+		}
+
+		for id, name := range targets {
+			if err := _DeleteUser(tx, stat, id, name); err != nil {
+				return err
+			}
+			deleted = append(deleted, name)
+		}
+		return nil
+	})
+	if err != nil {
+		logs.Error("delete users failed, nothing deleted. Error: ", err.Error())
+		return nil, 0, false
 	}
 
+	return deleted, reassigned, true
+}
+
+// _QueryDeleteTargets finds the users named "users", which must all be ones
+// the current user may delete, the same ones it may update: root every user
+// but itself, an admin only the users it created. The users which don't
+// exist are skipped.
+func _QueryDeleteTargets(tx db.DB, stat *db.DBStat, cur_id int64, cur_type int, users []string) (map[int64]string, error) {
+	targets := make(map[int64]string)
 	for _, v := range users {
-		// TODO: here is a situation NOT to handle,
-		// when deleting a admin user via root account,
-		// the normal users under this admin should be also deleted.
-		err := mysql.Delete(stat.Where("user_name", v).From())
+		rows, err := tx.Query(stat.Select("id", "user_type", "created_by").Where("user_name", v).From())
 		if err != nil {
-			logs.Error("db Delete operation failed. Error: ", err.Error())
-			return false
+			return nil, err
+		}
+		var (
+			id         int64
+			user_type  int
+			created_by int64
+		)
+		is_found := rows.Next()
+		if is_found {
+			err = rows.Scan(&id, &user_type, &created_by)
+		}
+		rows.Close()
+		if err != nil {
+			return nil, err
+		}
+		if !is_found {
+			logs.Warning("User \"%s\" to delete does NOT exist.", v)
+			continue
 		}
+
+		if id == cur_id || user_type == USER_ROOT_TYPE || (cur_type != USER_ROOT_TYPE && created_by != cur_id) {
+			return nil, fmt.Errorf("user \"%s\" is NOT owned by user id %d.", v, cur_id)
+		}
+		targets[id] = v
 	}
 
-	return true
+	return targets, nil
+}
+
+// _ExpandSubtree adds to "targets" the users created by them, and the users
+// created by those, and so on. The current user and root are never one of
+// them.
+func _ExpandSubtree(tx db.DB, stat *db.DBStat, cur_id int64, targets map[int64]string) error {
+	frontier := make([]int64, 0, len(targets))
+	for id := range targets {
+		frontier = append(frontier, id)
+	}
+
+	for len(frontier) != 0 {
+		var next []int64
+		for _, parent := range frontier {
+			children, err := _QueryUsers(tx, stat.Where("created_by", parent).Where("user_type !=", USER_ROOT_TYPE).From())
+			if err != nil {
+				return err
+			}
+			for id, name := range children {
+				if _, ok := targets[id]; ok || id == cur_id {
+					continue
+				}
+				targets[id] = name
+				next = append(next, id)
+			}
+		}
+		frontier = next
+	}
+
+	return nil
+}
+
+// _ReassignUsers moves the users created by "targets" to the admin
+// "reassign_to", it returns how many of them moved.
+func _ReassignUsers(tx db.DB, stat *db.DBStat, targets map[int64]string, reassign_to string) (int, error) {
+	rows, err := tx.Query(stat.Select("id", "user_type").Where("user_name", reassign_to).From())
+	if err != nil {
+		return 0, err
+	}
+	var admin_id int64
+	var admin_type int
+	is_found := rows.Next()
+	if is_found {
+		err = rows.Scan(&admin_id, &admin_type)
+	}
+	rows.Close()
+	if err != nil {
+		return 0, err
+	}
+	if _, ok := targets[admin_id]; !is_found || ok || admin_type > USER_ADMIN_TYPE {
+		return 0, fmt.Errorf("user \"%s\" is NOT an admin which is kept.", reassign_to)
+	}
+
+	n := 0
+	for parent := range targets {
+		children, err := _QueryUsers(tx, stat.Where("created_by", parent).From())
+		if err != nil {
+			return 0, err
+		}
+		for id := range children {
+			// the ones being deleted too don't count.
+			if _, ok := targets[id]; !ok {
+				n++
+			}
+		}
+		if len(children) == 0 {
+			continue
+		}
+		err = tx.Update(map[string]interface{}{"created_by": admin_id}, stat.Where("created_by", parent).From())
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return n, nil
+}
+
+// _DeleteUser deletes user "id" with its sessions and room memberships.
+func _DeleteUser(tx db.DB, stat *db.DBStat, id int64, name string) error {
+	if err := tx.Delete(stat.Where("id", id).From()); err != nil {
+		return err
+	}
+	if err := _DeleteUserSessions(tx, id); err != nil {
+		return err
+	}
+
+	member_stat, err := db.NewDBStat("chat_room_members")
+	if err != nil {
+		return err
+	}
+
+	return tx.Delete(member_stat.Where("user_name", name).From())
+}
+
+// _QueryUsers returns the ids and the names of the users "stat" matches.
+func _QueryUsers(d db.DB, stat *db.DBStat) (map[int64]string, error) {
+	users := make(map[int64]string)
+
+	rows, err := d.Query(stat.Select("id", "user_name"))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int64
+		var name string
+		if err := rows.Scan(&id, &name); err != nil {
+			return nil, err
+		}
+		users[id] = name
+	}
+
+	return users, rows.Err()
+}
+
+// GetUser returns the name and the type of user "id".
+func GetUser(id int64) (string, int, bool) {
+	logs.Debug("get user id: %d", id)
+
+	stat, err := db.NewDBStat("chat_users")
+	if err != nil {
+		logs.Error("NewDBStat failed. Error: ", err.Error())
+		return "", 0, false
+	}
+
+	rows, err := mysql.Query(stat.Select("user_name", "user_type").Where("id", id).From())
+	if err != nil {
+		logs.Error("db Query operation failed. Error: ", err.Error())
+		return "", 0, false
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		logs.Warning("User does NOT exist.")
+		return "", 0, false
+	}
+
+	var (
+		user_name string
+		user_type int
+	)
+	err = rows.Scan(&user_name, &user_type)
+	if err != nil {
+		logs.Error("db Rows Scan operation failed. Error: ", err.Error())
+		return "", 0, false
+	}
+
+	return user_name, user_type, true
 }
 
 func ListUser(id int64, start, length int) []string {
@@ -169,9 +458,6 @@ func ListUser(id int64, start, length int) []string {
 
 	users := make([]string, 0)
 
-	if _, ok := mysql.(*db.DBase); !ok {
-		Init()
-	}
 	stat, err := db.NewDBStat("chat_users")
 	if err != nil {
 		logs.Error("NewDBStat failed. Error: ", err.Error())
@@ -196,3 +482,291 @@ func ListUser(id int64, start, length int) []string {
 
 	return users
 }
+
+// ListAllUser lists every user whoever created it, for the services of the
+// REST API.
+func ListAllUser(start, length int) []string {
+	users := make([]string, 0)
+
+	stat, err := db.NewDBStat("chat_users")
+	if err != nil {
+		logs.Error("NewDBStat failed. Error: ", err.Error())
+		return users
+	}
+
+	rows, err := mysql.Query(stat.Select("user_name").OrderBy("id", false).Limit(start, length).From())
+	if err != nil {
+		logs.Error("db Query operation failed. Error: ", err.Error())
+		return users
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var user string
+		err := rows.Scan(&user)
+		if err != nil {
+			logs.Error("db Rows Scan operation failed. Error: ", err.Error())
+			return users
+		}
+		users = append(users, user)
+	}
+
+	return users
+}
+
+// FilterOwnedUsers returns the ones of "users" which user "cur_id" owns,
+// all of them for root, the ones it created for an admin.
+func FilterOwnedUsers(cur_id int64, cur_type int, users []string) []string {
+	if cur_type == USER_ROOT_TYPE {
+		return users
+	}
+
+	owned := make([]string, 0)
+
+	stat, err := db.NewDBStat("chat_users")
+	if err != nil {
+		logs.Error("NewDBStat failed. Error: ", err.Error())
+		return owned
+	}
+
+	for _, v := range users {
+		is_owned, err := mysql.Exist(stat.Where("user_name", v).Where("created_by", cur_id).From())
+		if err != nil {
+			logs.Error("db Exist operation failed. Error: ", err.Error())
+			return owned
+		}
+		if is_owned {
+			owned = append(owned, v)
+		}
+	}
+
+	return owned
+}
+
+// USER_TYPE_UNCHANGED is the "new_type" of an UpdateUser which keeps the
+// type of the user.
+const USER_TYPE_UNCHANGED = -1
+
+// UpdateUser renames user "name", changes its type or resets its password,
+// an empty "new_name" or "password" keeps them. Root may update every user
+// but itself, an admin only the users it created. Only root can grant the
+// admin type, nobody can grant the root type.
+func UpdateUser(cur_id int64, cur_type int, name, new_name string, new_type int, password string) bool {
+	logs.Debug("update user cur_id: %d, cur_type: %d", cur_id, cur_type)
+	logs.Debug("update user name: %s, new_name: %s, new_type: %d", name, new_name, new_type)
+
+	stat, err := db.NewDBStat("chat_users")
+	if err != nil {
+		logs.Error("NewDBStat failed. Error: ", err.Error())
+		return false
+	}
+
+	rows, err := mysql.Query(stat.Select("id", "user_type", "created_by").Where("user_name", name).From())
+	if err != nil {
+		logs.Error("db Query operation failed. Error: ", err.Error())
+		return false
+	}
+	var (
+		id         int64
+		user_type  int
+		created_by int64
+	)
+	is_found := rows.Next()
+	if is_found {
+		err = rows.Scan(&id, &user_type, &created_by)
+	}
+	rows.Close()
+	if err != nil {
+		logs.Error("db Rows Scan operation failed. Error: ", err.Error())
+		return false
+	}
+	if !is_found {
+		logs.Warning("User does NOT exist.")
+		return false
+	}
+
+	if user_type == USER_ROOT_TYPE || (cur_type != USER_ROOT_TYPE && created_by != cur_id) {
+		logs.Warning("User \"%s\" is NOT owned by user id %d.", name, cur_id)
+		return false
+	}
+	switch {
+	case new_type == USER_TYPE_UNCHANGED, new_type == USER_NORMAL_TYPE, new_type == USER_BOT_TYPE:
+	case new_type == USER_ADMIN_TYPE && cur_type == USER_ROOT_TYPE:
+	default:
+		logs.Warning("User type %d can NOT be granted by user type %d.", new_type, cur_type)
+		return false
+	}
+
+	data := make(map[string]interface{})
+	if new_type != USER_TYPE_UNCHANGED {
+		data["user_type"] = new_type
+	}
+	if password != "" {
+		hash, err := HashPassword(password)
+		if err != nil {
+			logs.Error("Hash password failed. Error: ", err.Error())
+			return false
+		}
+		data["passwd"] = hash
+	}
+	if new_name != "" && new_name != name {
+		data["user_name"] = new_name
+	}
+	if len(data) == 0 {
+		return true
+	}
+
+	err = mysql.WithTx(func(tx db.DB) error {
+		// the unique key of user_name has the last word, a concurrent add
+		// or rename of the same name fails the update.
+		if _, ok := data["user_name"]; ok {
+			is_exist, err := tx.Exist(stat.Where("user_name", new_name).From())
+			if err != nil {
+				return err
+			}
+			if is_exist {
+				return fmt.Errorf("user \"%s\" already exists.", new_name)
+			}
+		}
+		if err := tx.Update(data, stat.Where("id", id).From()); err != nil {
+			return err
+		}
+		// a reset password logs the user out everywhere.
+		if password != "" {
+			if err := _DeleteUserSessions(tx, id); err != nil {
+				return err
+			}
+		}
+		if _, ok := data["user_name"]; ok {
+			return _RenameUser(tx, name, new_name)
+		}
+		return nil
+	})
+	if err != nil {
+		logs.Error("update user failed, nothing updated. Error: ", err.Error())
+		return false
+	}
+
+	return true
+}
+
+// _RenameUser carries the rename of a user over to the rows which refer to
+// it by name: its room memberships, messages, receipts and offline
+// messages.
+func _RenameUser(tx db.DB, name, new_name string) error {
+	renames := []struct{ table, field string }{
+		{"chat_room_members", "user_name"},
+		{"chat_messages", "sender"},
+		{"chat_receipts", "user_name"},
+		{"chat_offline_msgs", "receiver"},
+	}
+	for _, v := range renames {
+		stat, err := db.NewDBStat(v.table)
+		if err != nil {
+			return err
+		}
+		if err := tx.Update(map[string]interface{}{v.field: new_name}, stat.Where(v.field, name).From()); err != nil {
+			return err
+		}
+	}
+
+	// the peers of a direct conversation are stored in order, a renamed
+	// peer may have to swap sides.
+	stat, err := db.NewDBStat("chat_messages")
+	if err != nil {
+		return err
+	}
+	for _, side := range [][2]string{{"peer_a", "peer_b"}, {"peer_b", "peer_a"}} {
+		rows, err := tx.Query(stat.Select("DISTINCT "+side[1]).Where(side[0], name).From())
+		if err != nil {
+			return err
+		}
+		var peers []string
+		for rows.Next() {
+			var peer string
+			if err := rows.Scan(&peer); err != nil {
+				rows.Close()
+				return err
+			}
+			peers = append(peers, peer)
+		}
+		rows.Close()
+
+		for _, peer := range peers {
+			a, b := _Peers(new_name, peer)
+			data := map[string]interface{}{"peer_a": a, "peer_b": b}
+			if err := tx.Update(data, stat.Where(side[0], name).Where(side[1], peer).From()); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// ChangePassword replaces the password of user "id", the old one must
+// match. Every session of the user but "token", the one of the device
+// changing it, is revoked.
+func ChangePassword(id int64, old_password, password, token string) bool {
+	logs.Debug("change password user id: %d", id)
+
+	stat, err := db.NewDBStat("chat_users")
+	if err != nil {
+		logs.Error("NewDBStat failed. Error: ", err.Error())
+		return false
+	}
+
+	rows, err := mysql.Query(stat.Select("passwd").Where("id", id).From())
+	if err != nil {
+		logs.Error("db Query operation failed. Error: ", err.Error())
+		return false
+	}
+	var passwd string
+	is_found := rows.Next()
+	if is_found {
+		err = rows.Scan(&passwd)
+	}
+	rows.Close()
+	if err != nil {
+		logs.Error("db Rows Scan operation failed. Error: ", err.Error())
+		return false
+	}
+	if !is_found {
+		logs.Warning("User does NOT exist.")
+		return false
+	}
+
+	if is_match, _ := CheckPassword(passwd, old_password); !is_match {
+		logs.Warning("User password is Wrong.")
+		return false
+	}
+
+	hash, err := HashPassword(password)
+	if err != nil {
+		logs.Error("Hash password failed. Error: ", err.Error())
+		return false
+	}
+	err = mysql.WithTx(func(tx db.DB) error {
+		if err := tx.Update(map[string]interface{}{"passwd": hash}, stat.Where("id", id).From()); err != nil {
+			return err
+		}
+		// a device logged in without a session keeps none.
+		if token == "" {
+			return _DeleteUserSessions(tx, id)
+		}
+		_, token_id, ok := ParseSession(token)
+		if !ok {
+			return _DeleteUserSessions(tx, id)
+		}
+		session_stat, err := db.NewDBStat("chat_sessions")
+		if err != nil {
+			return err
+		}
+		return tx.Delete(session_stat.Where("user_id", id).Where("token_id !=", token_id).From())
+	})
+	if err != nil {
+		logs.Error("change password failed, nothing changed. Error: ", err.Error())
+		return false
+	}
+
+	return true
+}
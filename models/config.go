@@ -0,0 +1,71 @@
+package models
+
+import (
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/astaxie/beego"
+	"github.com/astaxie/beego/logs"
+)
+
+const (
+	CONF_ENV_PREFIX = "CHAT_"
+)
+
+// ConfString reads setting "key" of conf/app.conf, "def" if it's not set.
+// The environment overrides the file, CHAT_<KEY> holds the value itself and
+// CHAT_<KEY>_FILE the path of a file holding it, e.g. a mounted secret.
+func ConfString(key, def string) string {
+	env := CONF_ENV_PREFIX + strings.ToUpper(key)
+	if v, ok := os.LookupEnv(env); ok {
+		return v
+	}
+	if path := os.Getenv(env + "_FILE"); path != "" {
+		b, err := ioutil.ReadFile(path)
+		if err == nil {
+			return strings.TrimRight(string(b), "\r\n")
+		}
+		logs.Error("Read \"%s\" from %s failed, fall back to app.conf. Error: %s", key, path, err.Error())
+	}
+
+	return beego.AppConfig.DefaultString(key, def)
+}
+
+func ConfInt(key string, def int) int {
+	v := ConfString(key, "")
+	if v == "" {
+		return def
+	}
+
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		logs.Error("Setting \"%s\" is NOT an integer: %q, use %d.", key, v, def)
+		return def
+	}
+
+	return i
+}
+
+// ConfIntMin reads an integer setting which must be at least "min", "def"
+// is used instead of a smaller value.
+func ConfIntMin(key string, def, min int) int {
+	i := ConfInt(key, def)
+	if i < min {
+		logs.Error("Setting \"%s\" must be at least %d, NOT %d, use %d.", key, min, i, def)
+		return def
+	}
+
+	return i
+}
+
+// ConfStrings splits a setting by ";" as beego does.
+func ConfStrings(key string) []string {
+	v := ConfString(key, "")
+	if v == "" {
+		return nil
+	}
+
+	return strings.Split(v, ";")
+}
@@ -10,6 +10,7 @@ import (
 	"shiftred/error"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/astaxie/beego/logs"
 )
@@ -21,9 +22,20 @@ type DB interface {
 	Update(values map[string]interface{}, stat *DBStat) error
 	Count(stat *DBStat) (int64, error)
 	Exist(stat *DBStat) (bool, error)
+	// WithTx runs "fn" in a transaction, it's committed if "fn" returns nil
+	// and rolled back otherwise. "fn" must do all its work through "tx", a
+	// WithTx of "tx" joins the same transaction.
+	WithTx(fn func(tx DB) error) error
 	Close() error
 }
 
+// _Executor is what *sql.DB and *sql.Tx have in common.
+type _Executor interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+	Prepare(query string) (*sql.Stmt, error)
+}
+
 type DBase struct {
 	d        string
 	user     string
@@ -33,18 +45,26 @@ type DBase struct {
 	port     string
 	table    string
 	db       *sql.DB
+	// set on the copies WithTx hands out.
+	tx *sql.Tx
 }
 
+// DBStat builds a statement with "?" placeholders, the values of its WHERE
+// clauses are bound as "args" instead of being spliced into the SQL. The
+// placeholders are rebound to "$n" when it runs on postgres.
 type DBStat struct {
 	table string
 
 	d_stat string
 	q_stat string
 	u_stat string
+	args   []interface{}
 }
 
+// New opens the database "database", an empty "pwd" is allowed for the
+// servers which don't ask for one.
 func New(db, user, pwd, database, host, port string) (DB, error) {
-	if db == "" || user == "" || pwd == "" || database == "" || host == "" || port == "" {
+	if db == "" || user == "" || database == "" || host == "" || port == "" {
 		return nil, MyErr.New(MyErr.DB_CONN_MISS_PARAMS, "miss Database Connection Paramters")
 	}
 
@@ -58,7 +78,10 @@ func New(db, user, pwd, database, host, port string) (DB, error) {
 
 	var err error
 	if db == "postgres" {
-		conn_str := []string{"user=" + r.user, "password=" + r.pwd, "dbname=" + r.database, "host=" + r.host, "port=" + r.port, "sslmode=disable"}
+		conn_str := []string{"user=" + r.user, "dbname=" + r.database, "host=" + r.host, "port=" + r.port, "sslmode=disable"}
+		if r.pwd != "" {
+			conn_str = append(conn_str, "password="+r.pwd)
+		}
 		r.db, err = sql.Open(db, strings.Join(conn_str, " "))
 		if err != nil {
 			return nil, err
@@ -97,10 +120,10 @@ func (this *DBStat) SetTable(name string) {
 }
 
 func (this *DBase) Query(stat *DBStat) (*sql.Rows, error) {
-	logs.Debug("DB Query Sql: ", stat.q_stat)
+	logs.Debug("DB Query Sql: %s, Args: %v", stat.q_stat, stat.args)
 
 	defer stat.ResetStat()
-	rows, err := this.db.Query(stat.q_stat)
+	rows, err := this._Ex().Query(this._Rebind(stat.q_stat), stat.args...)
 	if err != nil {
 		return nil, err
 	}
@@ -112,10 +135,10 @@ func (this *DBase) Count(stat *DBStat) (int64, error) {
 	var count int64
 
 	stat.q_stat = strings.Replace(stat.q_stat, "*", "COUNT(*)", 1)
-	logs.Debug("DB Count Sql: ", stat.q_stat)
+	logs.Debug("DB Count Sql: %s, Args: %v", stat.q_stat, stat.args)
 
 	defer stat.ResetStat()
-	err := this.db.QueryRow(stat.q_stat).Scan(&count)
+	err := this._Ex().QueryRow(this._Rebind(stat.q_stat), stat.args...).Scan(&count)
 	if err != nil {
 		return 0, err
 	}
@@ -136,16 +159,16 @@ func (this *DBase) Exist(stat *DBStat) (bool, error) {
 }
 
 func (this *DBase) Delete(stat *DBStat) error {
-	logs.Debug("DB Delete Sql: ", stat.d_stat)
+	logs.Debug("DB Delete Sql: %s, Args: %v", stat.d_stat, stat.args)
 
 	defer stat.ResetStat()
-	stmt, err := this.db.Prepare(stat.d_stat)
+	stmt, err := this._Ex().Prepare(this._Rebind(stat.d_stat))
 	if err != nil {
 		return err
 	}
 	defer stmt.Close()
 
-	_, err = stmt.Exec()
+	_, err = stmt.Exec(stat.args...)
 	if err != nil {
 		return err
 	}
@@ -154,37 +177,30 @@ func (this *DBase) Delete(stat *DBStat) error {
 }
 
 func (this *DBase) Update(values map[string]interface{}, stat *DBStat) error {
-	var set_st string
+	if len(values) == 0 {
+		return MyErr.New(MyErr.DB_INSERT_MISS_VALUES, "miss values in update statement.")
+	}
 
+	var sets []string
+	var vals []interface{}
 	for k, v := range values {
-		set_st += (k + " = ")
-		switch val := v.(type) {
-		case string:
-			set_st += "'" + val + "'"
-		case int:
-			set_st += strconv.FormatInt(int64(val), 10)
-		case int64:
-			set_st += strconv.FormatInt(int64(val), 10)
-		case float32:
-			set_st += strconv.FormatFloat(float64(val), 'f', -1, 64)
-		case float64:
-			set_st += strconv.FormatFloat(float64(val), 'f', -1, 64)
-		}
-		set_st += ", "
+		sets = append(sets, k+" = ?")
+		vals = append(vals, v)
 	}
-	set_st = strings.TrimRight(set_st, ", ")
+	// the SET placeholders come before the WHERE ones.
+	vals = append(vals, stat.args...)
 
-	stat.u_stat = strings.Replace(stat.u_stat, "[vars]", set_st, 1)
-	logs.Debug("DB Update Sql: ", stat.u_stat)
+	stat.u_stat = strings.Replace(stat.u_stat, "[vars]", strings.Join(sets, ", "), 1)
+	logs.Debug("DB Update Sql: %s, Args: %v", stat.u_stat, vals)
 
 	defer stat.ResetStat()
-	stmt, err := this.db.Prepare(stat.u_stat)
+	stmt, err := this._Ex().Prepare(this._Rebind(stat.u_stat))
 	if err != nil {
 		return err
 	}
 	defer stmt.Close()
 
-	_, err = stmt.Exec()
+	_, err = stmt.Exec(vals...)
 	if err != nil {
 		return err
 	}
@@ -217,7 +233,7 @@ func (this *DBase) Insert(values map[string]interface{}, stat *DBStat) (int64, e
 	keys_str = "(" + keys_str + ")"
 	stmt_str := "INSERT INTO " + stat.table + keys_str + " VALUES(" + marks_str + ")"
 	logs.Debug("DB Insert Sql: ", stmt_str)
-	stmt, err := this.db.Prepare(stmt_str)
+	stmt, err := this._Ex().Prepare(stmt_str)
 	if err != nil {
 		return 0, err
 	}
@@ -236,9 +252,84 @@ func (this *DBase) Insert(values map[string]interface{}, stat *DBStat) (int64, e
 	return row_count, nil
 }
 
+func (this *DBase) WithTx(fn func(tx DB) error) error {
+	if this.tx != nil {
+		return fn(this)
+	}
+
+	tx, err := this.db.Begin()
+	if err != nil {
+		return err
+	}
+	r := *this
+	r.tx = tx
+
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		}
+	}()
+	if err := fn(&r); err != nil {
+		if rb_err := tx.Rollback(); rb_err != nil {
+			logs.Error("db Rollback failed. Error: ", rb_err.Error())
+		}
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (this *DBase) _Ex() _Executor {
+	if this.tx != nil {
+		return this.tx
+	}
+
+	return this.db
+}
+
+// SetPool sizes the connection pool, 0 means no limit for "max_open" and
+// "lifetime", and no idle connection for "max_idle".
+func (this *DBase) SetPool(max_open, max_idle int, lifetime time.Duration) {
+	this.db.SetMaxOpenConns(max_open)
+	this.db.SetMaxIdleConns(max_idle)
+	this.db.SetConnMaxLifetime(lifetime)
+}
+
+// Ping checks that the database can be reached with the settings it was
+// opened with.
+func (this *DBase) Ping() error {
+	return this.db.Ping()
+}
+
+// _Rebind turns the "?" placeholders of "stat" into "$1", "$2"... for
+// postgres, mysql takes them as they are.
+func (this *DBase) _Rebind(stat string) string {
+	if this.d != "postgres" {
+		return stat
+	}
+
+	var b strings.Builder
+	n := 0
+	for _, c := range stat {
+		if c == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(c)
+	}
+
+	return b.String()
+}
+
 // it is rarely necessary to call it,
 // as golang demand sql driver should implemnt a connections pool for Database.
 func (this *DBase) Close() error {
+	if this.tx != nil {
+		return fmt.Errorf("Close the database inside a transaction.")
+	}
+
 	return this.db.Close()
 }
 
@@ -275,25 +366,14 @@ func (this *DBStat) _Where(field string, value interface{}, or bool) *DBStat {
 	}
 
 	if _, ok := _GetWhereOperator(field); !ok {
-		where_st += " = "
-	}
-
-	switch v := value.(type) {
-	case string:
-		where_st += "'" + v + "'"
-	case int:
-		where_st += strconv.FormatInt(int64(v), 10)
-	case int64:
-		where_st += strconv.FormatInt(int64(v), 10)
-	case float32:
-		where_st += strconv.FormatFloat(float64(v), 'f', -1, 64)
-	case float64:
-		where_st += strconv.FormatFloat(float64(v), 'f', -1, 64)
+		where_st += " ="
 	}
+	where_st += " ?"
 
 	this.q_stat += where_st
 	this.d_stat += where_st
 	this.u_stat += where_st
+	this.args = append(this.args, value)
 
 	return this
 }
@@ -306,8 +386,18 @@ func (this *DBStat) From() *DBStat {
 	return this
 }
 
+func (this *DBStat) OrderBy(field string, desc bool) *DBStat {
+	this.q_stat += " ORDER BY " + field
+	if desc {
+		this.q_stat += " DESC"
+	}
+
+	return this
+}
+
+// Limit pages the query, it's written the way both mysql and postgres take.
 func (this *DBStat) Limit(start, length int) *DBStat {
-	this.q_stat += " LIMIT " + strconv.FormatInt(int64(start), 10) + ", " + strconv.FormatInt(int64(length), 10)
+	this.q_stat += " LIMIT " + strconv.FormatInt(int64(length), 10) + " OFFSET " + strconv.FormatInt(int64(start), 10)
 
 	return this
 }
@@ -316,6 +406,7 @@ func (this *DBStat) ResetStat() {
 	this.q_stat = "SELECT * FROM [table]"
 	this.d_stat = "DELETE FROM [table]"
 	this.u_stat = "UPDATE [table] SET [vars]"
+	this.args = nil
 }
 
 func _GetWhereOperator(field string) (string, bool) {
@@ -339,7 +430,7 @@ func _GetWhereOperator(field string) (string, bool) {
 		return ">", true
 	}
 
-	if strings.Contains(field, ">") {
+	if strings.Contains(field, "<") {
 		return "<", true
 	}
 
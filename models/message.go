@@ -0,0 +1,353 @@
+package models
+
+import (
+	"chat_server/models/db"
+
+	"strings"
+
+	"github.com/astaxie/beego/logs"
+)
+
+func SaveOfflineMsg(receiver string, payload []byte, unix_ns int64) bool {
+	logs.Debug("save offline msg receiver: %s, unix_ns: %d", receiver, unix_ns)
+
+	stat, err := db.NewDBStat("chat_offline_msgs")
+	if err != nil {
+		logs.Error("NewDBStat failed. Error: ", err.Error())
+		return false
+	}
+
+	data := map[string]interface{}{
+		"receiver":   receiver,
+		"payload":    string(payload),
+		"created_at": unix_ns,
+	}
+	if _, err := mysql.Insert(data, stat); err != nil {
+		logs.Error("db Insert operation failed. Error: ", err.Error())
+		return false
+	}
+
+	return true
+}
+
+type OfflineMsg struct {
+	Id      int64
+	Payload []byte
+	UnixNs  int64
+}
+
+// LoadOfflineMsgs returns a page of at most "limit" rows stored for
+// "receiver" before until_unix_ns, after row "after_id", in the order they
+// were stored. The rows older than since_unix_ns are expired, they're not
+// returned but the largest row id of the page counts them too, so the
+// caller can drop them all with DeleteOfflineMsgs after a successful replay
+// and load the next page after it. The id is 0 when no row is left.
+func LoadOfflineMsgs(receiver string, since_unix_ns, until_unix_ns, after_id int64, limit int) ([]OfflineMsg, int64) {
+	logs.Debug("load offline msgs receiver: %s, since: %d, until: %d, after: %d", receiver, since_unix_ns, until_unix_ns, after_id)
+
+	msgs := make([]OfflineMsg, 0)
+	var last_id int64
+
+	stat, err := db.NewDBStat("chat_offline_msgs")
+	if err != nil {
+		logs.Error("NewDBStat failed. Error: ", err.Error())
+		return msgs, last_id
+	}
+
+	rows, err := mysql.Query(stat.Select("id", "payload", "created_at").Where("receiver", receiver).Where("id >", after_id).Where("created_at <", until_unix_ns).OrderBy("id", false).Limit(0, limit).From())
+	if err != nil {
+		logs.Error("db Query operation failed. Error: ", err.Error())
+		return msgs, last_id
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			m       OfflineMsg
+			payload string
+		)
+		err := rows.Scan(&m.Id, &payload, &m.UnixNs)
+		if err != nil {
+			logs.Error("db Rows Scan operation failed. Error: ", err.Error())
+			return msgs, last_id
+		}
+		last_id = m.Id
+		if m.UnixNs < since_unix_ns {
+			continue
+		}
+		m.Payload = []byte(payload)
+		msgs = append(msgs, m)
+	}
+
+	return msgs, last_id
+}
+
+func DeleteOfflineMsgs(receiver string, last_id int64) bool {
+	logs.Debug("delete offline msgs receiver: %s, last_id: %d", receiver, last_id)
+
+	if last_id == 0 {
+		return true
+	}
+
+	stat, err := db.NewDBStat("chat_offline_msgs")
+	if err != nil {
+		logs.Error("NewDBStat failed. Error: ", err.Error())
+		return false
+	}
+
+	err = mysql.Delete(stat.Where("receiver", receiver).Where("id <=", last_id).From())
+	if err != nil {
+		logs.Error("db Delete operation failed. Error: ", err.Error())
+		return false
+	}
+
+	return true
+}
+
+const (
+	HISTORY_DEFAULT_LIMIT = 50
+	HISTORY_MAX_LIMIT     = 200
+)
+
+// the messages of a backend service are stored with the name of the
+// service after this prefix as their sender, no user name may start with
+// it.
+const SERVICE_SENDER_PREFIX = "service:"
+
+// ServiceOf returns the service a message from "sender" comes from, an
+// empty string if a user sent it.
+func ServiceOf(sender string) string {
+	if !strings.HasPrefix(sender, SERVICE_SENDER_PREFIX) {
+		return ""
+	}
+
+	return sender[len(SERVICE_SENDER_PREFIX):]
+}
+
+type ChatMsg struct {
+	Id        int64
+	MsgId     string
+	Sender    string
+	Receiver  string
+	Room      string
+	Msg       string
+	CreatedAt int64
+}
+
+// _Peers orders the two ends of a direct conversation, so both directions
+// are stored under the same (peer_a, peer_b) pair.
+func _Peers(user, peer string) (string, string) {
+	if user < peer {
+		return user, peer
+	}
+
+	return peer, user
+}
+
+// SaveMsg stores a message in the conversation history, either once in
+// "room" or, when room is an empty string, once between "sender" and each
+// of the receivers. It's all stored or nothing is.
+func SaveMsg(msg_id, sender string, receivers []string, room, msg string, unix_ns int64) bool {
+	logs.Debug("save msg id: %s, sender: %s, receivers: %v, room: %s", msg_id, sender, receivers, room)
+
+	stat, err := db.NewDBStat("chat_messages")
+	if err != nil {
+		logs.Error("NewDBStat failed. Error: ", err.Error())
+		return false
+	}
+
+	err = mysql.WithTx(func(tx db.DB) error {
+		data := map[string]interface{}{
+			"msg_id":     msg_id,
+			"sender":     sender,
+			"room":       room,
+			"msg":        msg,
+			"created_at": unix_ns,
+		}
+		if room != "" {
+			_, err := tx.Insert(data, stat)
+			return err
+		}
+
+		for _, v := range receivers {
+			data["peer_a"], data["peer_b"] = _Peers(sender, v)
+			if _, err := tx.Insert(data, stat); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		logs.Error("db Insert operation failed. Error: ", err.Error())
+		return false
+	}
+
+	return true
+}
+
+// ListMsgs pages through the conversation between "user" and "peer", or of
+// "room" when it is not an empty string. "before" and "after" are exclusive
+// message ids, 0 means no bound. Without "after" the newest messages are
+// returned, the result is always ordered from oldest to newest.
+func ListMsgs(user, peer, room string, before, after int64, limit int) []ChatMsg {
+	logs.Debug("list msgs user: %s, peer: %s, room: %s", user, peer, room)
+	logs.Debug("list msgs before: %d, after: %d, limit: %d", before, after, limit)
+
+	msgs := make([]ChatMsg, 0)
+
+	if limit <= 0 {
+		limit = HISTORY_DEFAULT_LIMIT
+	} else if limit > HISTORY_MAX_LIMIT {
+		limit = HISTORY_MAX_LIMIT
+	}
+
+	stat, err := db.NewDBStat("chat_messages")
+	if err != nil {
+		logs.Error("NewDBStat failed. Error: ", err.Error())
+		return msgs
+	}
+
+	stat.Select("id", "msg_id", "sender", "peer_a", "peer_b", "room", "msg", "created_at")
+	if room != "" {
+		stat.Where("room", room)
+	} else {
+		peer_a, peer_b := _Peers(user, peer)
+		stat.Where("room", "").Where("peer_a", peer_a).Where("peer_b", peer_b)
+	}
+	if before > 0 {
+		stat.Where("id <", before)
+	}
+	if after > 0 {
+		stat.Where("id >", after)
+	}
+	// page forwards from "after", otherwise backwards from the newest.
+	is_desc := after <= 0
+	stat.OrderBy("id", is_desc).Limit(0, limit)
+
+	rows, err := mysql.Query(stat.From())
+	if err != nil {
+		logs.Error("db Query operation failed. Error: ", err.Error())
+		return msgs
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			m      ChatMsg
+			peer_a string
+			peer_b string
+		)
+		err := rows.Scan(&m.Id, &m.MsgId, &m.Sender, &peer_a, &peer_b, &m.Room, &m.Msg, &m.CreatedAt)
+		if err != nil {
+			logs.Error("db Rows Scan operation failed. Error: ", err.Error())
+			return msgs
+		}
+		if m.Room == "" {
+			m.Receiver = peer_b
+			if m.Sender == peer_b {
+				m.Receiver = peer_a
+			}
+		}
+		msgs = append(msgs, m)
+	}
+
+	if is_desc {
+		for i, j := 0, len(msgs)-1; i < j; i, j = i+1, j-1 {
+			msgs[i], msgs[j] = msgs[j], msgs[i]
+		}
+	}
+
+	return msgs
+}
+
+const (
+	RECEIPT_DELIVERED = 1
+	RECEIPT_READ      = 2
+)
+
+// GetMsg finds the message "msg_id" as it was addressed to "user", either
+// directly or through a room "user" is a member of.
+func GetMsg(msg_id, user string) (ChatMsg, bool) {
+	logs.Debug("get msg id: %s, user: %s", msg_id, user)
+
+	var found ChatMsg
+
+	stat, err := db.NewDBStat("chat_messages")
+	if err != nil {
+		logs.Error("NewDBStat failed. Error: ", err.Error())
+		return found, false
+	}
+
+	rows, err := mysql.Query(stat.Select("id", "msg_id", "sender", "peer_a", "peer_b", "room", "msg", "created_at").Where("msg_id", msg_id).From())
+	if err != nil {
+		logs.Error("db Query operation failed. Error: ", err.Error())
+		return found, false
+	}
+	defer rows.Close()
+	msgs := make([]ChatMsg, 0)
+	for rows.Next() {
+		var (
+			m      ChatMsg
+			peer_a string
+			peer_b string
+		)
+		err := rows.Scan(&m.Id, &m.MsgId, &m.Sender, &peer_a, &peer_b, &m.Room, &m.Msg, &m.CreatedAt)
+		if err != nil {
+			logs.Error("db Rows Scan operation failed. Error: ", err.Error())
+			return found, false
+		}
+		if m.Sender == user {
+			continue
+		}
+		if m.Room == "" && (peer_a == user || peer_b == user) {
+			m.Receiver = user
+			return m, true
+		}
+		if m.Room != "" {
+			msgs = append(msgs, m)
+		}
+	}
+
+	// room membership is checked after the rows are drained, as it needs
+	// a query of its own.
+	for _, m := range msgs {
+		if IsRoomMember(user, m.Room) {
+			return m, true
+		}
+	}
+
+	return found, false
+}
+
+// SetReceipt records that "user" got the message "msg_id" into "status".
+// It returns false if the receipt was already recorded, so that each
+// receipt is only reported to the sender once.
+func SetReceipt(msg_id, user string, status int, unix_ns int64) bool {
+	logs.Debug("set receipt msg id: %s, user: %s, status: %d", msg_id, user, status)
+
+	stat, err := db.NewDBStat("chat_receipts")
+	if err != nil {
+		logs.Error("NewDBStat failed. Error: ", err.Error())
+		return false
+	}
+
+	is_exist, err := mysql.Exist(stat.Where("msg_id", msg_id).Where("user_name", user).Where("status", status).From())
+	if err != nil {
+		logs.Error("db Exist operation failed. Error: ", err.Error())
+		return false
+	}
+	if is_exist {
+		return false
+	}
+
+	data := map[string]interface{}{
+		"msg_id":     msg_id,
+		"user_name":  user,
+		"status":     status,
+		"created_at": unix_ns,
+	}
+	if _, err := mysql.Insert(data, stat); err != nil {
+		logs.Error("db Insert operation failed. Error: ", err.Error())
+		return false
+	}
+
+	return true
+}
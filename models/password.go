@@ -0,0 +1,38 @@
+package models
+
+import (
+	"crypto/subtle"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	PASSWORD_HASH_COST = bcrypt.DefaultCost
+)
+
+func HashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), PASSWORD_HASH_COST)
+	if err != nil {
+		return "", err
+	}
+
+	return string(hash), nil
+}
+
+// CheckPassword compares "password" with the stored "passwd" column, which
+// is either a bcrypt hash or, for rows written before passwords were
+// hashed, the plaintext. The second result tells the caller the row is
+// still in plaintext and should be rehashed.
+func CheckPassword(passwd, password string) (bool, bool) {
+	if !_IsPasswordHash(passwd) {
+		return subtle.ConstantTimeCompare([]byte(passwd), []byte(password)) == 1, true
+	}
+
+	err := bcrypt.CompareHashAndPassword([]byte(passwd), []byte(password))
+	return err == nil, false
+}
+
+func _IsPasswordHash(passwd string) bool {
+	return strings.HasPrefix(passwd, "$2a$") || strings.HasPrefix(passwd, "$2b$") || strings.HasPrefix(passwd, "$2y$")
+}
@@ -0,0 +1,203 @@
+package models
+
+import (
+	"chat_server/models/db"
+
+	"github.com/astaxie/beego/logs"
+)
+
+func CreateRoom(cur_id int64, cur_user, room string) bool {
+	logs.Debug("create room cur_id: %d, cur_user: %s", cur_id, cur_user)
+	logs.Debug("create room name: ", room)
+
+	stat, err := db.NewDBStat("chat_rooms")
+	if err != nil {
+		logs.Error("NewDBStat failed. Error: ", err.Error())
+		return false
+	}
+
+	is_exist, err := mysql.Exist(stat.Where("room_name", room).From())
+	if err != nil {
+		logs.Error("db Exist operation failed. Error: ", err.Error())
+		return false
+	}
+	if is_exist {
+		logs.Warning("Room already exists.")
+		return false
+	}
+
+	err = mysql.WithTx(func(tx db.DB) error {
+		data := map[string]interface{}{
+			"room_name":  room,
+			"created_by": cur_id,
+		}
+		if _, err := tx.Insert(data, stat); err != nil {
+			return err
+		}
+
+		// the creator is always the first member of the room.
+		return _AddRoomMember(tx, cur_user, room)
+	})
+	if err != nil {
+		logs.Error("db Insert operation failed. Error: ", err.Error())
+		return false
+	}
+
+	return true
+}
+
+func JoinRoom(user, room string) bool {
+	logs.Debug("join room user: %s, room: %s", user, room)
+
+	room_stat, err := db.NewDBStat("chat_rooms")
+	if err != nil {
+		logs.Error("NewDBStat failed. Error: ", err.Error())
+		return false
+	}
+
+	is_exist, err := mysql.Exist(room_stat.Where("room_name", room).From())
+	if err != nil {
+		logs.Error("db Exist operation failed. Error: ", err.Error())
+		return false
+	}
+	if !is_exist {
+		logs.Warning("Room does NOT exist.")
+		return false
+	}
+
+	if IsRoomMember(user, room) {
+		return true
+	}
+
+	if err := _AddRoomMember(mysql, user, room); err != nil {
+		logs.Error("db Insert operation failed. Error: ", err.Error())
+		return false
+	}
+
+	return true
+}
+
+func _AddRoomMember(d db.DB, user, room string) error {
+	stat, err := db.NewDBStat("chat_room_members")
+	if err != nil {
+		return err
+	}
+	data := map[string]interface{}{
+		"room_name": room,
+		"user_name": user,
+	}
+	_, err = d.Insert(data, stat)
+
+	return err
+}
+
+func LeaveRoom(user, room string) bool {
+	logs.Debug("leave room user: %s, room: %s", user, room)
+
+	if !IsRoomMember(user, room) {
+		logs.Warning("User is NOT a member of the room.")
+		return false
+	}
+
+	stat, err := db.NewDBStat("chat_room_members")
+	if err != nil {
+		logs.Error("NewDBStat failed. Error: ", err.Error())
+		return false
+	}
+	err = mysql.Delete(stat.Where("room_name", room).Where("user_name", user).From())
+	if err != nil {
+		logs.Error("db Delete operation failed. Error: ", err.Error())
+		return false
+	}
+
+	return true
+}
+
+func IsRoomMember(user, room string) bool {
+	stat, err := db.NewDBStat("chat_room_members")
+	if err != nil {
+		logs.Error("NewDBStat failed. Error: ", err.Error())
+		return false
+	}
+
+	is_exist, err := mysql.Exist(stat.Where("room_name", room).Where("user_name", user).From())
+	if err != nil {
+		logs.Error("db Exist operation failed. Error: ", err.Error())
+		return false
+	}
+
+	return is_exist
+}
+
+// ListRooms lists all rooms, or only the rooms "user" has joined when it is
+// not an empty string.
+func ListRooms(user string, start, length int) []string {
+	logs.Debug("list rooms user: ", user)
+	logs.Debug("list rooms, start: ", start)
+	logs.Debug("list rooms, length: ", length)
+
+	rooms := make([]string, 0)
+
+	var stat *db.DBStat
+	var err error
+	if user != "" {
+		stat, err = db.NewDBStat("chat_room_members")
+		if err == nil {
+			stat.Where("user_name", user)
+		}
+	} else {
+		stat, err = db.NewDBStat("chat_rooms")
+	}
+	if err != nil {
+		logs.Error("NewDBStat failed. Error: ", err.Error())
+		return rooms
+	}
+
+	rows, err := mysql.Query(stat.Select("room_name").Limit(start, length).From())
+	if err != nil {
+		logs.Error("db Query operation failed. Error: ", err.Error())
+		return rooms
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var room string
+		err := rows.Scan(&room)
+		if err != nil {
+			logs.Error("db Rows Scan operation failed. Error: ", err.Error())
+			return rooms
+		}
+		rooms = append(rooms, room)
+	}
+
+	return rooms
+}
+
+func ListRoomMembers(room string) []string {
+	logs.Debug("list room members, room: ", room)
+
+	members := make([]string, 0)
+
+	stat, err := db.NewDBStat("chat_room_members")
+	if err != nil {
+		logs.Error("NewDBStat failed. Error: ", err.Error())
+		return members
+	}
+
+	rows, err := mysql.Query(stat.Select("user_name").Where("room_name", room).From())
+	if err != nil {
+		logs.Error("db Query operation failed. Error: ", err.Error())
+		return members
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var member string
+		err := rows.Scan(&member)
+		if err != nil {
+			logs.Error("db Rows Scan operation failed. Error: ", err.Error())
+			return members
+		}
+		members = append(members, member)
+	}
+
+	return members
+}
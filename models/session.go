@@ -0,0 +1,175 @@
+package models
+
+import (
+	"chat_server/models/db"
+
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/astaxie/beego/logs"
+)
+
+var (
+	SESSION_TTL = time.Duration(ConfIntMin("session_ttl", 7*24*3600, 1)) * time.Second
+
+	g_session_secret = _SessionSecret()
+)
+
+func _SessionSecret() []byte {
+	if secret := ConfString("session_secret", ""); secret != "" {
+		return []byte(secret)
+	}
+
+	logs.Warning("\"session_secret\" is NOT configured, session tokens won't survive a restart.")
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// _SignSession signs the "<user_id>.<expires_at>.<token_id>" part of a token.
+func _SignSession(payload string) string {
+	mac := hmac.New(sha256.New, g_session_secret)
+	mac.Write([]byte(payload))
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// CreateSession issues a session token of user "id", it returns the token
+// and its expiry in unix nanoseconds, or an empty token on failure.
+func CreateSession(id int64) (string, int64) {
+	logs.Debug("create session user id: %d", id)
+
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		logs.Error("Generate token id failed. Error: ", err.Error())
+		return "", 0
+	}
+	token_id := hex.EncodeToString(b)
+	expires_at := time.Now().Add(SESSION_TTL).UnixNano()
+
+	stat, err := db.NewDBStat("chat_sessions")
+	if err != nil {
+		logs.Error("NewDBStat failed. Error: ", err.Error())
+		return "", 0
+	}
+
+	// drop the expired sessions of the user on the way.
+	err = mysql.Delete(stat.Where("user_id", id).Where("expires_at <", time.Now().UnixNano()).From())
+	if err != nil {
+		logs.Error("db Delete operation failed. Error: ", err.Error())
+	}
+
+	data := map[string]interface{}{
+		"token_id":   token_id,
+		"user_id":    id,
+		"expires_at": expires_at,
+	}
+	if _, err := mysql.Insert(data, stat); err != nil {
+		logs.Error("db Insert operation failed. Error: ", err.Error())
+		return "", 0
+	}
+
+	payload := strconv.FormatInt(id, 10) + "." + strconv.FormatInt(expires_at, 10) + "." + token_id
+	return payload + "." + _SignSession(payload), expires_at
+}
+
+// ParseSession checks the signature and the expiry of "token", it returns
+// the user id and the token id it carries.
+func ParseSession(token string) (int64, string, bool) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 4 {
+		logs.Warning("Malformed session token.")
+		return 0, "", false
+	}
+
+	payload := strings.Join(parts[:3], ".")
+	if !hmac.Equal([]byte(_SignSession(payload)), []byte(parts[3])) {
+		logs.Warning("Session token signature mismatch.")
+		return 0, "", false
+	}
+
+	id, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		logs.Warning("Malformed session token user id.")
+		return 0, "", false
+	}
+	expires_at, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || expires_at <= time.Now().UnixNano() {
+		logs.Warning("Session token expired.")
+		return 0, "", false
+	}
+
+	return id, parts[2], true
+}
+
+// ResumeSession re-authenticates with a token from CreateSession, like
+// UserLogin it returns the id, name and type of the user, or 0 if the token
+// is invalid, expired or revoked.
+func ResumeSession(token string) (int64, string, int) {
+	id, token_id, ok := ParseSession(token)
+	if !ok {
+		return 0, "", 0
+	}
+
+	stat, err := db.NewDBStat("chat_sessions")
+	if err != nil {
+		logs.Error("NewDBStat failed. Error: ", err.Error())
+		return 0, "", 0
+	}
+
+	is_exist, err := mysql.Exist(stat.Where("token_id", token_id).Where("user_id", id).From())
+	if err != nil {
+		logs.Error("db Exist operation failed. Error: ", err.Error())
+		return 0, "", 0
+	}
+	if !is_exist {
+		logs.Warning("Session token is revoked.")
+		return 0, "", 0
+	}
+
+	name, user_type, ok := GetUser(id)
+	if !ok {
+		return 0, "", 0
+	}
+
+	return id, name, user_type
+}
+
+// RevokeSession invalidates "token", e.g. on logout.
+func RevokeSession(token string) bool {
+	_, token_id, ok := ParseSession(token)
+	if !ok {
+		return false
+	}
+	logs.Debug("revoke session token id: ", token_id)
+
+	stat, err := db.NewDBStat("chat_sessions")
+	if err != nil {
+		logs.Error("NewDBStat failed. Error: ", err.Error())
+		return false
+	}
+
+	err = mysql.Delete(stat.Where("token_id", token_id).From())
+	if err != nil {
+		logs.Error("db Delete operation failed. Error: ", err.Error())
+		return false
+	}
+
+	return true
+}
+
+func _DeleteUserSessions(d db.DB, id int64) error {
+	stat, err := db.NewDBStat("chat_sessions")
+	if err != nil {
+		return err
+	}
+
+	return d.Delete(stat.Where("user_id", id).From())
+}
@@ -13,4 +13,25 @@ func init() {
 			AllowHTTPMethods: []string{"get"},
 			Params: nil})
 
+	beego.GlobalControllerRouter["chat_server/controllers:ApiController"] = append(beego.GlobalControllerRouter["chat_server/controllers:ApiController"],
+		beego.ControllerComments{
+			Method: "PostMessage",
+			Router: `/messages`,
+			AllowHTTPMethods: []string{"post"},
+			Params: nil})
+
+	beego.GlobalControllerRouter["chat_server/controllers:ApiController"] = append(beego.GlobalControllerRouter["chat_server/controllers:ApiController"],
+		beego.ControllerComments{
+			Method: "ListUsers",
+			Router: `/users`,
+			AllowHTTPMethods: []string{"get"},
+			Params: nil})
+
+	beego.GlobalControllerRouter["chat_server/controllers:ApiController"] = append(beego.GlobalControllerRouter["chat_server/controllers:ApiController"],
+		beego.ControllerComments{
+			Method: "ListOnline",
+			Router: `/online`,
+			AllowHTTPMethods: []string{"get"},
+			Params: nil})
+
 }
@@ -21,4 +21,11 @@ func init() {
 	)
 	beego.AddNamespace(ns)
 
+	api := beego.NewNamespace("/api",
+		beego.NSInclude(
+			&controllers.ApiController{},
+		),
+	)
+	beego.AddNamespace(api)
+
 }
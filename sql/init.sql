@@ -1,8 +1,35 @@
 CREATE TABLE IF NOT EXISTS chat_users(
     id bigint NOT NULL AUTO_INCREMENT,
     user_name varchar(128) NOT NULL,
-    passwd varchar(32) NOT NULL,
+    passwd varchar(255) NOT NULL,
     user_type int NOT NULL,
     created_by bigint NOT NULL,
-    PRIMARY KEY(id)
+    PRIMARY KEY(id),
+    UNIQUE KEY(user_name)
+)ENGINE = innoDB DEFAULT CHARACTER SET = utf8;
+
+CREATE TABLE IF NOT EXISTS chat_rooms(
+    id bigint NOT NULL AUTO_INCREMENT,
+    room_name varchar(128) NOT NULL,
+    created_by bigint NOT NULL,
+    PRIMARY KEY(id),
+    UNIQUE KEY(room_name)
+)ENGINE = innoDB DEFAULT CHARACTER SET = utf8;
+
+CREATE TABLE IF NOT EXISTS chat_room_members(
+    id bigint NOT NULL AUTO_INCREMENT,
+    room_name varchar(128) NOT NULL,
+    user_name varchar(128) NOT NULL,
+    PRIMARY KEY(id),
+    UNIQUE KEY(room_name, user_name)
+)ENGINE = innoDB DEFAULT CHARACTER SET = utf8;
+
+CREATE TABLE IF NOT EXISTS chat_sessions(
+    id bigint NOT NULL AUTO_INCREMENT,
+    token_id varchar(64) NOT NULL,
+    user_id bigint NOT NULL,
+    expires_at bigint NOT NULL,
+    PRIMARY KEY(id),
+    UNIQUE KEY(token_id),
+    KEY(user_id)
 )ENGINE = innoDB DEFAULT CHARACTER SET = utf8;
@@ -0,0 +1,33 @@
+CREATE TABLE IF NOT EXISTS chat_offline_msgs(
+    id bigint NOT NULL AUTO_INCREMENT,
+    receiver varchar(128) NOT NULL,
+    payload text NOT NULL,
+    created_at bigint NOT NULL,
+    PRIMARY KEY(id),
+    KEY(receiver)
+)ENGINE = innoDB DEFAULT CHARACTER SET = utf8;
+
+CREATE TABLE IF NOT EXISTS chat_messages(
+    id bigint NOT NULL AUTO_INCREMENT,
+    msg_id varchar(64) NOT NULL,
+    sender varchar(128) NOT NULL,
+    peer_a varchar(128) NOT NULL DEFAULT '',
+    peer_b varchar(128) NOT NULL DEFAULT '',
+    room varchar(128) NOT NULL DEFAULT '',
+    msg text NOT NULL,
+    created_at bigint NOT NULL,
+    PRIMARY KEY(id),
+    KEY(peer_a, peer_b, id),
+    KEY(room, id),
+    KEY(msg_id)
+)ENGINE = innoDB DEFAULT CHARACTER SET = utf8;
+
+CREATE TABLE IF NOT EXISTS chat_receipts(
+    id bigint NOT NULL AUTO_INCREMENT,
+    msg_id varchar(64) NOT NULL,
+    user_name varchar(128) NOT NULL,
+    status int NOT NULL,
+    created_at bigint NOT NULL,
+    PRIMARY KEY(id),
+    UNIQUE KEY(msg_id, user_name, status)
+)ENGINE = innoDB DEFAULT CHARACTER SET = utf8;
@@ -0,0 +1,36 @@
+-- the schema of init.sql for db_driver = postgres.
+CREATE TABLE IF NOT EXISTS chat_users(
+    id bigserial NOT NULL,
+    user_name varchar(128) NOT NULL,
+    passwd varchar(255) NOT NULL,
+    user_type int NOT NULL,
+    created_by bigint NOT NULL,
+    PRIMARY KEY(id),
+    UNIQUE(user_name)
+);
+
+CREATE TABLE IF NOT EXISTS chat_rooms(
+    id bigserial NOT NULL,
+    room_name varchar(128) NOT NULL,
+    created_by bigint NOT NULL,
+    PRIMARY KEY(id),
+    UNIQUE(room_name)
+);
+
+CREATE TABLE IF NOT EXISTS chat_room_members(
+    id bigserial NOT NULL,
+    room_name varchar(128) NOT NULL,
+    user_name varchar(128) NOT NULL,
+    PRIMARY KEY(id),
+    UNIQUE(room_name, user_name)
+);
+
+CREATE TABLE IF NOT EXISTS chat_sessions(
+    id bigserial NOT NULL,
+    token_id varchar(64) NOT NULL,
+    user_id bigint NOT NULL,
+    expires_at bigint NOT NULL,
+    PRIMARY KEY(id),
+    UNIQUE(token_id)
+);
+CREATE INDEX IF NOT EXISTS chat_sessions_user_id ON chat_sessions(user_id);
@@ -0,0 +1,2 @@
+CREATE DATABASE chat ENCODING 'UTF8';
+GRANT ALL PRIVILEGES ON DATABASE chat TO sdkbox;
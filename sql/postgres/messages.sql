@@ -0,0 +1,34 @@
+-- the schema of messages.sql for db_driver = postgres.
+CREATE TABLE IF NOT EXISTS chat_offline_msgs(
+    id bigserial NOT NULL,
+    receiver varchar(128) NOT NULL,
+    payload text NOT NULL,
+    created_at bigint NOT NULL,
+    PRIMARY KEY(id)
+);
+CREATE INDEX IF NOT EXISTS chat_offline_msgs_receiver ON chat_offline_msgs(receiver);
+
+CREATE TABLE IF NOT EXISTS chat_messages(
+    id bigserial NOT NULL,
+    msg_id varchar(64) NOT NULL,
+    sender varchar(128) NOT NULL,
+    peer_a varchar(128) NOT NULL DEFAULT '',
+    peer_b varchar(128) NOT NULL DEFAULT '',
+    room varchar(128) NOT NULL DEFAULT '',
+    msg text NOT NULL,
+    created_at bigint NOT NULL,
+    PRIMARY KEY(id)
+);
+CREATE INDEX IF NOT EXISTS chat_messages_peers ON chat_messages(peer_a, peer_b, id);
+CREATE INDEX IF NOT EXISTS chat_messages_room ON chat_messages(room, id);
+CREATE INDEX IF NOT EXISTS chat_messages_msg_id ON chat_messages(msg_id);
+
+CREATE TABLE IF NOT EXISTS chat_receipts(
+    id bigserial NOT NULL,
+    msg_id varchar(64) NOT NULL,
+    user_name varchar(128) NOT NULL,
+    status int NOT NULL,
+    created_at bigint NOT NULL,
+    PRIMARY KEY(id),
+    UNIQUE(msg_id, user_name, status)
+);
@@ -0,0 +1,3 @@
+-- widen the column for password hashes, the plaintext passwords of existing
+-- rows are rehashed on their next successful login.
+ALTER TABLE chat_users MODIFY passwd varchar(255) NOT NULL;
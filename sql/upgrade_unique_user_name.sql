@@ -0,0 +1,6 @@
+-- user names must be unique, the rows are looked up by name. Rename or
+-- delete the duplicates this lists before adding the key, it fails while
+-- there are any.
+SELECT user_name, COUNT(*) FROM chat_users GROUP BY user_name HAVING COUNT(*) > 1;
+
+ALTER TABLE chat_users ADD UNIQUE KEY(user_name);